@@ -0,0 +1,90 @@
+package lua_debugger
+
+import "sync"
+
+// emmyAdapter is the Facade side of a Transport speaking another protocol,
+// like DapTransport and MobdebugTransport: the commands of the IDE are
+// passed to the Facade as the emmy requests
+type emmyAdapter struct {
+	handler func(int, interface{})
+	answers answers
+}
+
+func (a *emmyAdapter) SetHandler(handler func(int, interface{})) {
+	a.handler = handler
+}
+
+// emmy passes the message to the Facade as if it's from the IDE
+func (a *emmyAdapter) emmy(cmd int, msg interface{}) {
+	if a.handler != nil {
+		a.handler(cmd, msg)
+	}
+}
+
+// request is like emmy, and calls fn with the answer of the Facade, which is
+// rspCmd. Every request answered with rspCmd must go through it
+func (a *emmyAdapter) request(cmd int, msg interface{}, rspCmd int, fn func(success bool, err string)) {
+	a.answers.expect(rspCmd, fn)
+	a.emmy(cmd, msg)
+}
+
+// answers pairs the answers of the Facade with the requests an adapter made,
+// the Facade answers the requests of a kind in order
+type answers struct {
+	m       sync.Mutex
+	waiters map[int][]func(success bool, err string)
+	held    map[int][]func()
+}
+
+// expect queues fn for the answer of the next request answered with rspCmd,
+// fn may be nil
+func (a *answers) expect(rspCmd int, fn func(success bool, err string)) {
+	a.m.Lock()
+	if a.waiters == nil {
+		a.waiters = make(map[int][]func(success bool, err string))
+	}
+	a.waiters[rspCmd] = append(a.waiters[rspCmd], fn)
+	a.m.Unlock()
+}
+
+// answer calls the first function waiting for rspCmd, then the ones held
+// until no more request is waiting for it
+func (a *answers) answer(rspCmd int, success bool, err string) {
+	a.m.Lock()
+	waiters := a.waiters[rspCmd]
+	if len(waiters) == 0 {
+		a.m.Unlock()
+		return
+	}
+	fn := waiters[0]
+	a.waiters[rspCmd] = waiters[1:]
+	var held []func()
+	if len(waiters) == 1 {
+		held = a.held[rspCmd]
+		delete(a.held, rspCmd)
+	}
+	a.m.Unlock()
+
+	if fn != nil {
+		fn(success, err)
+	}
+	for _, fn := range held {
+		fn()
+	}
+}
+
+// after runs fn once no request is waiting for rspCmd, e.g. a break right
+// after a step is reported after the step is answered
+func (a *answers) after(rspCmd int, fn func()) {
+	a.m.Lock()
+	if len(a.waiters[rspCmd]) > 0 {
+		if a.held == nil {
+			a.held = make(map[int][]func())
+		}
+		a.held[rspCmd] = append(a.held[rspCmd], fn)
+		a.m.Unlock()
+		return
+	}
+	a.m.Unlock()
+	fn()
+}
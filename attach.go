@@ -0,0 +1,229 @@
+package lua_debugger
+
+import (
+	"errors"
+	"fmt"
+	lua "github.com/yuin/gopher-lua"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// EnvDebug is the environment variable read by AttachFromEnv
+const EnvDebug = "GLUA_DEBUG"
+
+var envModes = map[string]string{
+	"connect":     "tcpConnect",
+	"listen":      "tcpListen",
+	"shared":      "tcpSharedListen",
+	"pipe":        "pipeConnect",
+	"pipeconnect": "pipeConnect",
+	"pipelisten":  "pipeListen",
+	"ws":          "wsConnect",
+	"wsconnect":   "wsConnect",
+	"wslisten":    "wsListen",
+	"dap":         "dapListen",
+	"mobdebug":    "mobdebugConnect",
+}
+
+// AttachOptions tells Attach how to reach the IDE
+type AttachOptions struct {
+	Options
+	// Mode is the name of the emmy_core function to use: tcpConnect,
+	// tcpListen, tcpSharedListen, pipeConnect, pipeListen, wsConnect,
+	// wsListen, dapListen or mobdebugConnect
+	Mode string
+	// Addr is host:port for tcp and wsListen, the socket path for the pipes
+	// and the url for wsConnect
+	Addr string
+}
+
+// Attach starts debugging L from go, so the lua code doesn't need to require
+// emmy_core. Call it before L runs the code to debug, the hooks are set when
+// L starts running. Like the lua functions, it waits for the IDE unless
+// opts.NonBlocking is set. opts is required, it tells where the IDE is
+func Attach(L *lua.LState, opts *AttachOptions) error {
+	if opts == nil {
+		return errors.New("no attach options")
+	}
+	if fcd := getFacade(L); fcd != nil {
+		if !fcd.isClosed() {
+			return errors.New("already attached")
+		}
+		// closed by the IDE before L runs again
+		fcd.detach(L)
+	}
+
+	if opts.Mode == "tcpSharedListen" {
+		host, port, err := splitHostPort(opts.Addr)
+		if err != nil {
+			return err
+		}
+		return joinSharedFacade(L, host, port, &opts.Options)
+	}
+
+	fcd := registerFacade(L)
+	err := attach(fcd, L, opts)
+	if err != nil {
+		unregisterFacade(L)
+	}
+	return err
+}
+
+func attach(fcd *Facade, L *lua.LState, opts *AttachOptions) error {
+	switch opts.Mode {
+	case "pipeConnect":
+		return fcd.PipeConnect(L, opts.Addr, &opts.Options)
+	case "pipeListen":
+		return fcd.PipeListen(L, opts.Addr, &opts.Options)
+	case "wsConnect":
+		return fcd.WsConnect(L, opts.Addr, &opts.Options)
+	}
+
+	host, port, err := splitHostPort(opts.Addr)
+	if err != nil {
+		return err
+	}
+	switch opts.Mode {
+	case "tcpConnect":
+		return fcd.TcpConnect(L, host, port, &opts.Options)
+	case "tcpListen":
+		return fcd.TcpListen(L, host, port, &opts.Options)
+	case "wsListen":
+		return fcd.WsListen(L, host, port, &opts.Options)
+	case "dapListen":
+		return fcd.DapListen(L, host, port, &opts.Options)
+	case "mobdebugConnect":
+		return fcd.MobdebugConnect(L, host, port, &opts.Options)
+	}
+	return errors.New("unknown mode: " + opts.Mode)
+}
+
+// Listen starts the listener shared by the states attached with the
+// tcpSharedListen mode on addr, so the IDE can connect before any state. Like
+// the one started by the first state, it's closed when the last state detaches
+func Listen(addr string, opts *Options) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	_, err = sharedFacade(host, port, opts)
+	return err
+}
+
+// Detach stops debugging L, it must be called on the goroutine running L.
+// The connection is closed unless it's shared with other states
+func Detach(L *lua.LState) {
+	fcd := getFacade(L)
+	if fcd == nil {
+		return
+	}
+	if fcd.shared {
+		// the others are still using the connection
+		fcd.RemoveState(L)
+	} else {
+		fcd.Stop(L)
+	}
+	unregisterFacade(L)
+}
+
+// Observe lets the client at the other end of t watch the session of L
+// read-only, e.g. the second end of a MemTransport pair
+func Observe(L *lua.LState, t Transport) error {
+	fcd := getFacade(L)
+	if fcd == nil || fcd.isClosed() {
+		return errors.New("not attached")
+	}
+	fcd.AddObserver(t)
+	return nil
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+// envAttached is set once a state is attached by AttachFromEnv
+var envAttached int32
+
+// AttachFromEnv attaches L as told by the GLUA_DEBUG environment variable,
+// it does nothing if the variable is empty. Only the first state of the
+// process is attached, the others would dial or listen on the same address
+// again, except in the shared mode, which is meant for many states. See
+// ParseDebugSpec for the format
+func AttachFromEnv(L *lua.LState) error {
+	spec := os.Getenv(EnvDebug)
+	if spec == "" {
+		return nil
+	}
+	opts, err := ParseDebugSpec(spec)
+	if err != nil {
+		return err
+	}
+	if opts.Mode != "tcpSharedListen" && !atomic.CompareAndSwapInt32(&envAttached, 0, 1) {
+		return nil
+	}
+	return Attach(L, opts)
+}
+
+// ParseDebugSpec parses "mode:addr[,flag...]", e.g.
+//
+//	connect:localhost:9966
+//	listen:0.0.0.0:9966,pause,nowait
+//	pipeListen:/tmp/emmy.sock,wait=5000,secret=xxx
+//
+// mode is connect, listen, shared, pipeConnect, pipeListen, wsConnect,
+// wsListen, dap, mobdebug or the name of an emmy_core function. The flags
+// are pause (break at the first line once the IDE is ready), nowait,
+// wait=<timeout in ms>, reconnect and secret=<secret>
+func ParseDebugSpec(spec string) (*AttachOptions, error) {
+	parts := strings.Split(spec, ",")
+	idx := strings.Index(parts[0], ":")
+	if idx < 0 {
+		return nil, fmt.Errorf("invalid debug spec %q, mode:addr expected", spec)
+	}
+
+	opts := &AttachOptions{Addr: parts[0][idx+1:]}
+	mode := parts[0][:idx]
+	if m, ok := envModes[strings.ToLower(mode)]; ok {
+		opts.Mode = m
+	} else {
+		opts.Mode = mode
+	}
+
+	for _, flag := range parts[1:] {
+		name, value := flag, ""
+		if i := strings.Index(flag, "="); i >= 0 {
+			name, value = flag[:i], flag[i+1:]
+		}
+		switch name {
+		case "pause":
+			opts.PauseOnEntry = true
+		case "nowait":
+			opts.NonBlocking = true
+		case "wait":
+			ms, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid wait %q: %v", value, err)
+			}
+			opts.WaitTimeout = time.Duration(ms) * time.Millisecond
+		case "reconnect":
+			opts.Reconnect = DefaultReconnectPolicy()
+		case "secret":
+			opts.Secret = value
+		default:
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+	}
+	return opts, nil
+}
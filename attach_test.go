@@ -0,0 +1,177 @@
+package lua_debugger
+
+import (
+	"fmt"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	lua "github.com/yuin/gopher-lua"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAttach(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	attached := make(chan error, 1)
+	go func() {
+		attached <- Attach(L, &AttachOptions{Mode: "tcpListen", Addr: addr})
+	}()
+
+	trans := &NetTransport{}
+	ide := newTestIDE(t, trans)
+	_, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+	for i := 0; ; i++ {
+		if err = trans.Connect("127.0.0.1", portNum); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ide.start(nil, proto.BreakPoint{File: "<string>", Line: 2})
+	select {
+	case err := <-attached:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not attached")
+	}
+	ide.expectStarted()
+
+	// the script knows nothing about the debugger
+	done := make(chan error, 1)
+	go func() {
+		done <- L.DoString(`local a = 1
+			result = a + 1`)
+	}()
+
+	ide.expectBreak()
+	ide.action(proto.Continue)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lua not continued")
+	}
+
+	Detach(L)
+	if getFacade(L) != nil {
+		t.Fatal("facade not removed")
+	}
+}
+
+func TestAttach_NoOptions(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	if err := Attach(L, nil); err == nil {
+		t.Fatal("attached without options")
+	}
+	if getFacade(L) != nil {
+		t.Fatal("facade registered")
+	}
+}
+
+func TestParseDebugSpec(t *testing.T) {
+	opts, err := ParseDebugSpec("listen:0.0.0.0:9966,pause,nowait,wait=500,reconnect,secret=a=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Mode != "tcpListen" || opts.Addr != "0.0.0.0:9966" || !opts.PauseOnEntry || !opts.NonBlocking ||
+		opts.WaitTimeout != 500*time.Millisecond || opts.Reconnect == nil || opts.Secret != "a=b" {
+		t.Fatal("unexpected options", opts)
+	}
+
+	opts, err = ParseDebugSpec("pipeListen:/tmp/emmy.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Mode != "pipeListen" || opts.Addr != "/tmp/emmy.sock" {
+		t.Fatal("unexpected options", opts)
+	}
+
+	for _, spec := range []string{"localhost", "connect:localhost:9966,unknown", "connect:localhost:9966,wait=x"} {
+		if _, err := ParseDebugSpec(spec); err == nil {
+			t.Fatal("invalid spec accepted:", spec)
+		}
+	}
+}
+
+func TestPreload_Env(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	_ = os.Setenv(EnvDebug, fmt.Sprintf("listen:127.0.0.1:%d,pause", port))
+	defer os.Unsetenv(EnvDebug)
+	atomic.StoreInt32(&envAttached, 0)
+
+	L := lua.NewState()
+	defer L.Close()
+	preloaded := make(chan struct{})
+	go func() {
+		Preload(L)
+		close(preloaded)
+	}()
+
+	trans := &NetTransport{}
+	ide := newTestIDE(t, trans)
+	for i := 0; ; i++ {
+		if err = trans.Connect("127.0.0.1", port); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ide.start(nil)
+	select {
+	case <-preloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not attached")
+	}
+	ide.expectStarted()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- L.DoString(`local a = 1`)
+	}()
+
+	// paused on entry without any breakpoint
+	ide.expectBreak()
+	ide.action(proto.Continue)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lua not continued")
+	}
+
+	// only the first state is attached
+	L2 := lua.NewState()
+	defer L2.Close()
+	Preload(L2)
+	if getFacade(L2) != nil {
+		t.Fatal("second state attached")
+	}
+}
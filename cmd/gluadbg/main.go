@@ -0,0 +1,137 @@
+// gluadbg is a command line debugger for the lua states debugged with
+// gopherlua-debugger, it speaks the emmy protocol like the EmmyLua IDE and
+// is driven by gdb style commands.
+//
+// By default it listens on :9966 for a state calling tcpConnect, with
+// -connect it connects to a state calling tcpListen:
+//
+//	gluadbg -b main.lua:10
+//	gluadbg -connect localhost:9966
+//
+// -secret, -cert, -key and -ca match the secret and tls options of the
+// debugged state.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	lua_debugger "github.com/edolphin-ydf/gopherlua-debugger"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+)
+
+type breakFlags []string
+
+func (b *breakFlags) String() string {
+	return strings.Join(*b, ",")
+}
+
+func (b *breakFlags) Set(s string) error {
+	*b = append(*b, s)
+	return nil
+}
+
+func main() {
+	listen := flag.String("listen", ":9966", "the address to wait for the debugger on")
+	connect := flag.String("connect", "", "the address of a listening debugger, host:port")
+	var breaks breakFlags
+	flag.Var(&breaks, "b", "set a breakpoint file:line before the start, may be repeated")
+	secret := flag.String("secret", "", "the secret of the debugger")
+	certFile := flag.String("cert", "", "the tls certificate, required by -listen with tls")
+	keyFile := flag.String("key", "", "the key of the tls certificate")
+	caFile := flag.String("ca", "", "the ca to verify the certificate of the debugger")
+	flag.Parse()
+
+	t := &lua_debugger.NetTransport{}
+	if *certFile != "" || *caFile != "" {
+		config, err := lua_debugger.LoadTLSConfig(*certFile, *keyFile, *caFile)
+		if err != nil {
+			log.Fatalln("load tls config fail:", err)
+		}
+		t.TLSConfig = config
+	}
+	r := newRepl(t, os.Stdout)
+	r.secret = *secret
+	for _, b := range breaks {
+		if err := r.addBreakpoint(b); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *connect != "" {
+		host, port, err := splitHostPort(*connect)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := t.Connect(host, port); err != nil {
+			log.Fatalln("connect debugger fail:", err)
+		}
+	} else {
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatalln("listen fail:", err)
+		}
+		if t.TLSConfig != nil {
+			l = tls.NewListener(l, t.TLSConfig)
+		}
+		fmt.Printf("Waiting for the debugger on %s\n", l.Addr())
+		c, err := l.Accept()
+		_ = l.Close()
+		if err != nil {
+			log.Fatalln("accept debugger fail:", err)
+		}
+		t.ServeConn(c)
+	}
+	r.start()
+
+	// ctrl-c breaks the running program
+	interrupt := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for range signals {
+			if r.isRunning() {
+				r.exec("pause")
+			}
+			select {
+			case interrupt <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		if r.isRunning() {
+			r.wait(interrupt)
+		}
+		select {
+		case <-r.closed:
+			return
+		default:
+		}
+		fmt.Print("(gluadbg) ")
+		if !in.Scan() || !r.exec(in.Text()) {
+			break
+		}
+	}
+	_ = t.Close()
+}
+
+func splitHostPort(address string) (string, int, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad port %q", p)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	lua_debugger "github.com/edolphin-ydf/gopherlua-debugger"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the time to wait for the EvalRsp of print
+const evalTimeout = 5 * time.Second
+
+const helpText = `break|b file:line [if expr]  set a breakpoint
+delete|d [N]                 delete breakpoint N, or all of them
+cond N [expr]                set or clear the condition of breakpoint N
+info break                   list the breakpoints
+continue|c                   continue running
+next|n                       step over
+step|s                       step in
+finish                       step out
+pause                        break at the next line run
+bt                           print the stack
+frame|f N                    select the frame N
+locals                       print the locals of the selected frame
+print|p expr                 evaluate expr in the selected frame
+quit|q                       detach and quit
+`
+
+var logTypeNames = map[proto.LogType]string{
+	proto.LogInfo:    "info",
+	proto.LogWarning: "warning",
+	proto.LogError:   "error",
+}
+
+type breakpoint struct {
+	id int
+	proto.BreakPoint
+}
+
+// repl is the IDE side of a debug session driven by gdb style commands
+type repl struct {
+	t   lua_debugger.Transport
+	out io.Writer
+	// secret is sent in AuthReq first if it's set
+	secret string
+
+	m       sync.Mutex
+	bps     []*breakpoint
+	nextId  int
+	stacks  []proto.Stack
+	frame   int
+	started bool
+	running bool
+	evalSeq int
+	evals   map[int]chan *proto.EvalRsp
+
+	stopped chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newRepl(t lua_debugger.Transport, out io.Writer) *repl {
+	r := &repl{
+		t:       t,
+		out:     out,
+		nextId:  1,
+		evals:   make(map[int]chan *proto.EvalRsp),
+		stopped: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	t.SetHandler(r.handleMsg)
+	return r
+}
+
+// start starts the session, the breakpoints set before are sent with it
+func (r *repl) start() {
+	if r.secret != "" {
+		r.t.Send(proto.MsgIdAuthReq, &proto.AuthReq{Secret: r.secret})
+	}
+	r.t.Send(proto.MsgIdInitReq, &proto.InitReq{
+		Ext:          []string{".lua"},
+		Version:      proto.Version,
+		Capabilities: []string{proto.CapLineBreakpoint, proto.CapConditionBreakpoint, proto.CapEval, proto.CapErrorNotify},
+	})
+	r.m.Lock()
+	var bps []proto.BreakPoint
+	for _, bp := range r.bps {
+		bps = append(bps, bp.BreakPoint)
+	}
+	r.started = true
+	r.running = true
+	r.m.Unlock()
+	if len(bps) > 0 {
+		r.t.Send(proto.MsgIdAddBreakPointReq, &proto.AddBreakPointReq{BreakPoints: bps})
+	}
+	r.t.Send(proto.MsgIdReadyReq, &proto.ReadyReq{})
+}
+
+func (r *repl) handleMsg(cmd int, msg interface{}) {
+	if cmd == lua_debugger.MsgIdFrameError {
+		// logged by the transport
+		return
+	}
+	switch m := msg.(type) {
+	case *proto.BreakNotify:
+		var stacks []proto.Stack
+		for _, stack := range m.Stacks {
+			if stack.Line >= 0 {
+				stacks = append(stacks, stack)
+			}
+		}
+		if len(stacks) == 0 {
+			return
+		}
+		r.m.Lock()
+		r.stacks = stacks
+		r.frame = 0
+		r.running = false
+		r.m.Unlock()
+		r.printf("Stopped at %s:%d\n", stacks[0].File, stacks[0].Line)
+		select {
+		case r.stopped <- struct{}{}:
+		default:
+		}
+	case *proto.EvalRsp:
+		r.m.Lock()
+		ch := r.evals[m.Seq]
+		delete(r.evals, m.Seq)
+		r.m.Unlock()
+		if ch != nil {
+			ch <- m
+		}
+	case *proto.InitRsp:
+		r.printf("Connected to debugger %s\n", m.Version)
+	case *proto.AuthRsp:
+		if !m.Success {
+			r.printf("Authentication fail: %s\n", m.Error)
+		}
+	case *proto.ErrorNotify:
+		r.printf("Debugger error: %s\n", m.Error)
+	case *proto.LogNotify:
+		if m.Output {
+			r.printf("%s", m.Message)
+		} else {
+			r.printf("[%s] %s\n", logTypeNames[m.Type], m.Message)
+		}
+	case *proto.AddBreakPointRsp:
+		if !m.Success {
+			r.printf("Breakpoint rejected: %s\n", m.Error)
+		}
+	case *proto.RemoveBreakPointRsp:
+		if !m.Success {
+			r.printf("Delete fail: %s\n", m.Error)
+		}
+	case *proto.ActionRsp:
+		if !m.Success {
+			r.printf("Action fail: %s\n", m.Error)
+		}
+	case *proto.ActionReq:
+		// the transport lost the debugger
+		if m.Action == proto.Stop {
+			r.printf("Disconnected\n")
+			r.once.Do(func() {
+				close(r.closed)
+			})
+		}
+	}
+	if cmd == lua_debugger.MsgIdSendFailed {
+		r.printf("Send fail: %v\n", msg)
+	}
+}
+
+func (r *repl) printf(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(r.out, format, args...)
+}
+
+// isRunning reports whether the debugged program is running
+func (r *repl) isRunning() bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.running
+}
+
+// wait waits until the program stops or the debugger is gone, it returns
+// false when interrupted
+func (r *repl) wait(interrupt <-chan struct{}) bool {
+	select {
+	case <-r.stopped:
+		return true
+	case <-r.closed:
+		return true
+	case <-interrupt:
+		return false
+	}
+}
+
+// exec runs a command line, it returns false when the repl should quit
+func (r *repl) exec(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+	command, args := fields[0], fields[1:]
+
+	var err error
+	switch command {
+	case "break", "b":
+		err = r.addBreakpoint(strings.TrimSpace(line[len(command):]))
+	case "delete", "d":
+		err = r.deleteBreakpoint(args)
+	case "cond":
+		err = r.setCondition(strings.TrimSpace(line[len(command):]))
+	case "info":
+		r.listBreakpoints()
+	case "continue", "c":
+		err = r.resume(proto.Continue)
+	case "next", "n":
+		err = r.resume(proto.StepOver)
+	case "step", "s":
+		err = r.resume(proto.StepIn)
+	case "finish":
+		err = r.resume(proto.StepOut)
+	case "pause":
+		r.t.Send(proto.MsgIdActionReq, &proto.ActionReq{Action: proto.Break})
+	case "bt":
+		err = r.backtrace()
+	case "frame", "f":
+		err = r.selectFrame(args)
+	case "locals":
+		err = r.locals()
+	case "print", "p":
+		err = r.print(strings.TrimSpace(line[len(command):]))
+	case "quit", "q":
+		return false
+	case "help", "h":
+		r.printf("%s", helpText)
+	default:
+		err = fmt.Errorf("unknown command %q, try help", command)
+	}
+	if err != nil {
+		r.printf("%v\n", err)
+	}
+	return true
+}
+
+// parseBreakpoint parses "file:line [if expr]"
+func parseBreakpoint(s string) (proto.BreakPoint, error) {
+	var bp proto.BreakPoint
+	location := s
+	if i := strings.Index(s, " if "); i >= 0 {
+		location, bp.Condition = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+len(" if "):])
+	}
+	i := strings.LastIndex(location, ":")
+	if i <= 0 {
+		return bp, errors.New("usage: break file:line [if expr]")
+	}
+	line, err := strconv.Atoi(location[i+1:])
+	if err != nil || line <= 0 {
+		return bp, fmt.Errorf("bad line %q", location[i+1:])
+	}
+	bp.File = location[:i]
+	bp.Line = line
+	return bp, nil
+}
+
+func (r *repl) addBreakpoint(s string) error {
+	bp, err := parseBreakpoint(s)
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	b := &breakpoint{id: r.nextId, BreakPoint: bp}
+	r.nextId++
+	r.bps = append(r.bps, b)
+	started := r.started
+	r.m.Unlock()
+
+	// the breakpoints set before are sent by start
+	if started {
+		r.t.Send(proto.MsgIdAddBreakPointReq, &proto.AddBreakPointReq{BreakPoints: []proto.BreakPoint{bp}})
+	}
+	r.printf("Breakpoint %d at %s:%d\n", b.id, bp.File, bp.Line)
+	return nil
+}
+
+func (r *repl) findBreakpoint(arg string) (int, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return -1, fmt.Errorf("bad breakpoint number %q", arg)
+	}
+	for i, bp := range r.bps {
+		if bp.id == id {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("no breakpoint number %d", id)
+}
+
+func (r *repl) deleteBreakpoint(args []string) error {
+	r.m.Lock()
+	if len(args) == 0 {
+		r.bps = nil
+		r.m.Unlock()
+		r.t.Send(proto.MsgIdAddBreakPointReq, &proto.AddBreakPointReq{Clear: true})
+		return nil
+	}
+
+	i, err := r.findBreakpoint(args[0])
+	if err != nil {
+		r.m.Unlock()
+		return err
+	}
+	bp := r.bps[i]
+	r.bps = append(r.bps[:i], r.bps[i+1:]...)
+	r.m.Unlock()
+
+	r.t.Send(proto.MsgIdRemoveBreakPointReq, &proto.RemoveBreakPointReq{BreakPoints: []proto.BreakPoint{bp.BreakPoint}})
+	return nil
+}
+
+// setCondition parses "N [expr]", the expression is kept as typed
+func (r *repl) setCondition(args string) error {
+	if args == "" {
+		return errors.New("usage: cond N [expr]")
+	}
+	id, expr := args, ""
+	if i := strings.IndexAny(args, " \t"); i >= 0 {
+		id, expr = args[:i], strings.TrimSpace(args[i+1:])
+	}
+
+	r.m.Lock()
+	i, err := r.findBreakpoint(id)
+	if err != nil {
+		r.m.Unlock()
+		return err
+	}
+	bp := r.bps[i]
+	bp.Condition = expr
+	r.m.Unlock()
+
+	// the debugger replaces a breakpoint by removing one at the line
+	r.t.Send(proto.MsgIdRemoveBreakPointReq, &proto.RemoveBreakPointReq{BreakPoints: []proto.BreakPoint{bp.BreakPoint}})
+	r.t.Send(proto.MsgIdAddBreakPointReq, &proto.AddBreakPointReq{BreakPoints: []proto.BreakPoint{bp.BreakPoint}})
+	return nil
+}
+
+func (r *repl) listBreakpoints() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if len(r.bps) == 0 {
+		r.printf("No breakpoints\n")
+		return
+	}
+	for _, bp := range r.bps {
+		r.printf("%d\t%s:%d", bp.id, bp.File, bp.Line)
+		if bp.Condition != "" {
+			r.printf(" if %s", bp.Condition)
+		}
+		r.printf("\n")
+	}
+}
+
+func (r *repl) resume(action proto.DebugAction) error {
+	r.m.Lock()
+	if r.stacks == nil {
+		r.m.Unlock()
+		return errors.New("the program is not stopped")
+	}
+	r.stacks = nil
+	r.running = true
+	r.m.Unlock()
+
+	// a stop of the last run isn't for this one
+	select {
+	case <-r.stopped:
+	default:
+	}
+	r.t.Send(proto.MsgIdActionReq, &proto.ActionReq{Action: action})
+	return nil
+}
+
+// currentFrame returns the selected frame, the program must be stopped
+func (r *repl) currentFrame() (proto.Stack, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.stacks == nil {
+		return proto.Stack{}, errors.New("the program is not stopped")
+	}
+	return r.stacks[r.frame], nil
+}
+
+func (r *repl) backtrace() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.stacks == nil {
+		return errors.New("the program is not stopped")
+	}
+	for i, stack := range r.stacks {
+		mark := " "
+		if i == r.frame {
+			mark = "*"
+		}
+		r.printf("%s#%d  %s at %s:%d\n", mark, i, functionName(stack), stack.File, stack.Line)
+	}
+	return nil
+}
+
+func (r *repl) selectFrame(args []string) error {
+	if len(args) == 0 {
+		stack, err := r.currentFrame()
+		if err != nil {
+			return err
+		}
+		r.printf("%s at %s:%d\n", functionName(stack), stack.File, stack.Line)
+		return nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("bad frame number %q", args[0])
+	}
+
+	r.m.Lock()
+	if r.stacks == nil {
+		r.m.Unlock()
+		return errors.New("the program is not stopped")
+	}
+	if n < 0 || n >= len(r.stacks) {
+		r.m.Unlock()
+		return fmt.Errorf("no frame %d", n)
+	}
+	r.frame = n
+	stack := r.stacks[n]
+	r.m.Unlock()
+
+	r.printf("#%d  %s at %s:%d\n", n, functionName(stack), stack.File, stack.Line)
+	return nil
+}
+
+func (r *repl) locals() error {
+	stack, err := r.currentFrame()
+	if err != nil {
+		return err
+	}
+	if len(stack.LocalVariables) == 0 {
+		r.printf("No locals\n")
+	}
+	for _, v := range stack.LocalVariables {
+		r.printf("%s = %s\n", v.Name, formatValue(v))
+	}
+	return nil
+}
+
+func (r *repl) print(expr string) error {
+	if expr == "" {
+		return errors.New("usage: print expr")
+	}
+	stack, err := r.currentFrame()
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *proto.EvalRsp, 1)
+	r.m.Lock()
+	r.evalSeq++
+	seq := r.evalSeq
+	r.evals[seq] = ch
+	r.m.Unlock()
+
+	r.t.Send(proto.MsgIdEvalReq, &proto.EvalReq{Seq: seq, Expr: expr, StackLevel: stack.Level, Depth: 2})
+	select {
+	case rsp := <-ch:
+		if !rsp.Success || rsp.Value == nil {
+			return fmt.Errorf("error: %s", rsp.Error)
+		}
+		r.printf("%s\n", formatValue(rsp.Value))
+		return nil
+	case <-r.closed:
+		return errors.New("disconnected")
+	case <-time.After(evalTimeout):
+		r.m.Lock()
+		delete(r.evals, seq)
+		r.m.Unlock()
+		return errors.New("no response from the debugger")
+	}
+}
+
+func functionName(stack proto.Stack) string {
+	if stack.FunctionName == "" {
+		return "?"
+	}
+	return stack.FunctionName
+}
+
+// formatValue formats v like a lua literal, a table with the fields loaded
+func formatValue(v *proto.Variable) string {
+	switch v.ValueType {
+	case lua_debugger.LUA_TSTRING:
+		return strconv.Quote(v.Value)
+	case lua_debugger.LUA_TTABLE:
+		if len(v.Children) == 0 {
+			return v.Value
+		}
+		var fields []string
+		for _, child := range v.Children {
+			fields = append(fields, child.Name+" = "+formatValue(child))
+		}
+		sort.Strings(fields)
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+	return v.Value
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	lua_debugger "github.com/edolphin-ydf/gopherlua-debugger"
+	lua "github.com/yuin/gopher-lua"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testScript = `connect()
+local t = {x = 1}
+for i = 1, 3 do
+	t.x = t.x + i
+end
+result = t.x
+`
+
+type syncBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.b.Write(p)
+}
+
+// take returns the output since the last take
+func (b *syncBuffer) take() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	s := b.b.String()
+	b.b.Reset()
+	return s
+}
+
+func TestRepl(t *testing.T) {
+	dbgSide, ideSide := lua_debugger.NewMemTransportPair()
+	defer ideSide.Close()
+	out := &syncBuffer{}
+	r := newRepl(ideSide, out)
+	r.secret = "s3cret"
+	r.exec("break test.lua:4 if i == 2")
+	r.start()
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := lua_debugger.Connect(L, dbgSide, &lua_debugger.Options{Secret: "s3cret"}); err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+	done := make(chan error, 1)
+	go func() {
+		fn, err := L.Load(strings.NewReader(testScript), "test.lua")
+		if err == nil {
+			L.Push(fn)
+			err = L.PCall(0, 0, nil)
+		}
+		done <- err
+	}()
+
+	expectStop := func() {
+		select {
+		case <-r.stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not stopped", out.take())
+		}
+	}
+	expectOutput := func(command string, want string) {
+		r.exec(command)
+		if got := out.take(); !strings.Contains(got, want) {
+			t.Fatalf("%s: expect %q in %q", command, want, got)
+		}
+	}
+
+	expectStop()
+	if got := out.take(); !strings.Contains(got, "Stopped at") || !strings.Contains(got, ":4") {
+		t.Fatal("unexpected stop", got)
+	}
+	expectOutput("print i", "2")
+	expectOutput("p t", "{x = 2}")
+	expectOutput("locals", "i = 2")
+	expectOutput("bt", "#0")
+
+	// the spaces in a string stay
+	expectOutput(`cond 1 tostring(i) ~= "a  b"`, "")
+	expectOutput("info break", `if tostring(i) ~= "a  b"`)
+	expectOutput("cond 1", "")
+	expectOutput("next", "")
+	expectStop()
+	expectOutput("print t.x", "4")
+
+	expectOutput("delete 1", "")
+	expectOutput("info break", "No breakpoints")
+	expectOutput("c", "")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("script not done", out.take())
+	}
+	if lua.LVAsNumber(L.GetGlobal("result")) != 7 {
+		t.Fatal("unexpected result", L.GetGlobal("result"))
+	}
+	expectOutput("print t", "not stopped")
+}
@@ -0,0 +1,128 @@
+package lua_debugger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+)
+
+// DefaultCompressThreshold is the size of json from which a message is
+// compressed
+const DefaultCompressThreshold = 1024
+
+// Compressor is a Transport which sends the large messages gzipped in a
+// proto.Compressed once enabled, the peer must have proto.CapCompress. The
+// received proto.Compressed are always unpacked
+type Compressor struct {
+	// Threshold is the min size of the json to compress
+	Threshold int
+	// MaxFrameSize limits the size of an unpacked message, a larger one is
+	// dropped like a large frame. DefaultMaxFrameSize if 0
+	MaxFrameSize int
+
+	t       Transport
+	enabled int32
+}
+
+func NewCompressor(t Transport) *Compressor {
+	return &Compressor{Threshold: DefaultCompressThreshold, t: t}
+}
+
+// SetEnabled turns the compression of the sent messages on or off
+func (c *Compressor) SetEnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&c.enabled, v)
+}
+
+func (c *Compressor) Send(cmd int, msg interface{}) {
+	if atomic.LoadInt32(&c.enabled) == 0 {
+		c.t.Send(cmd, msg)
+		return
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("send msg fail:", err)
+		return
+	}
+	if len(data) < c.Threshold {
+		c.t.Send(cmd, json.RawMessage(data))
+		return
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(data)
+	_ = w.Close()
+	c.t.Send(proto.MsgIdCompressed, proto.Compressed{Cmd: cmd, Data: buf.Bytes()})
+}
+
+func (c *Compressor) SetHandler(handler func(int, interface{})) {
+	c.t.SetHandler(func(cmd int, msg interface{}) {
+		if cmd != proto.MsgIdCompressed {
+			handler(cmd, msg)
+			return
+		}
+
+		compressed := msg.(*proto.Compressed)
+		inner, err := decompress(compressed, c.maxFrameSize(), c.newMsg)
+		if err != nil {
+			log.Println("drop msg:", compressed.Cmd, err)
+			handler(MsgIdFrameError, &proto.ErrorNotify{Cmd: compressed.Cmd, Error: err.Error()})
+			return
+		}
+		handler(compressed.Cmd, inner)
+	})
+}
+
+func (c *Compressor) Close() error {
+	return c.t.Close()
+}
+
+// newMsg decodes the unpacked messages like t decodes the others
+func (c *Compressor) newMsg(cmd int) interface{} {
+	if t, ok := c.t.(interface{ newMsg(int) interface{} }); ok {
+		return t.newMsg(cmd)
+	}
+	return proto.GetMsg(cmd)
+}
+
+func (c *Compressor) maxFrameSize() int {
+	if c.MaxFrameSize > 0 {
+		return c.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
+
+// decompress unpacks the message, the json larger than maxSize is not read
+// to the end, so a small gzip bomb can't take all the memory
+func decompress(compressed *proto.Compressed, maxSize int, newMsg func(int) interface{}) (interface{}, error) {
+	msg := newMsg(compressed.Cmd)
+	if msg == nil || compressed.Cmd == proto.MsgIdCompressed {
+		return nil, errors.New("unknown cmd")
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed.Data))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, errFrameTooLarge
+	}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
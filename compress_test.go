@@ -0,0 +1,40 @@
+package lua_debugger
+
+import (
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"strings"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	comp := NewCompressor(dbgSide)
+	comp.SetEnabled(true)
+	dbg := newTestIDE(t, comp)
+
+	// small messages are sent as is
+	comp.Send(proto.MsgIdEvalRsp, proto.EvalRsp{Seq: 1})
+	if rsp := ide.expect(&proto.EvalRsp{}).(*proto.EvalRsp); rsp.Seq != 1 {
+		t.Fatal("unexpected msg", rsp)
+	}
+
+	big := strings.Repeat("x", 2*DefaultCompressThreshold)
+	comp.Send(proto.MsgIdEvalRsp, proto.EvalRsp{Seq: 2, Error: big})
+	compressed := ide.expect(&proto.Compressed{}).(*proto.Compressed)
+	if compressed.Cmd != proto.MsgIdEvalRsp || len(compressed.Data) >= len(big) {
+		t.Fatal("msg not compressed", compressed)
+	}
+
+	// the received ones are unpacked
+	ideComp := NewCompressor(ide)
+	ideComp.SetEnabled(true)
+	ideComp.Send(proto.MsgIdEvalReq, proto.EvalReq{Seq: 3, Expr: big})
+	if req := dbg.expect(&proto.EvalReq{}).(*proto.EvalReq); req.Expr != big {
+		t.Fatal("unexpected msg", req)
+	}
+
+	// the unpacked size is limited
+	if _, err := decompress(compressed, len(big), proto.GetMsg); err != errFrameTooLarge {
+		t.Fatal("large msg unpacked", err)
+	}
+}
@@ -0,0 +1,348 @@
+package lua_debugger
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	lua "github.com/yuin/gopher-lua"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the time an eval of the control API waits for the result
+const controlEvalTimeout = 10 * time.Second
+
+var controlActions = map[string]proto.DebugAction{
+	"break":    proto.Break,
+	"continue": proto.Continue,
+	"stepOver": proto.StepOver,
+	"stepIn":   proto.StepIn,
+	"stepOut":  proto.StepOut,
+	"stop":     proto.Stop,
+}
+
+// ControlState is an attached state listed by the control API
+type ControlState struct {
+	Id      int  `json:"id"`
+	Stopped bool `json:"stopped"`
+}
+
+type controlEvalReq struct {
+	Expr  string `json:"expr"`
+	Level int    `json:"level"`
+	Depth int    `json:"depth"`
+}
+
+type controlActionReq struct {
+	Action string `json:"action"`
+}
+
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// controlServer serves the JSON control API of a Facade over http, for the
+// tools that don't speak the emmy protocol. It works along with the IDE:
+//
+//	GET    /states                     the attached states
+//	GET    /breakpoints                the breakpoints
+//	POST   /breakpoints                add a breakpoint {file, line, condition}
+//	DELETE /breakpoints?file=&line=    remove a breakpoint, or all without a query
+//	GET    /stacks                     the stacks of the state at a break
+//	POST   /eval                       evaluate {expr, level, depth} at a break
+//	POST   /action                     {action}, one of break, continue,
+//	                                   stepOver, stepIn, stepOut and stop
+//
+// The errors are {error} with a 4xx status. If the session has a secret,
+// it must be sent as "Authorization: Bearer <secret>". The bodies must be
+// sent as application/json, and on a loopback address or a unix socket the
+// Host must be a loopback one, so a web page can't drive the API
+type controlServer struct {
+	f        *Facade
+	l        net.Listener
+	srv      *http.Server
+	loopback bool
+
+	m      sync.Mutex
+	ids    map[*lua.LState]int
+	nextId int
+}
+
+// ListenControl serves the control API on addr, a host:port or a unix
+// socket path prefixed with "unix:", until f is closed. Anyone reaching the
+// API can run lua code, so a non-loopback address needs a secret
+func (f *Facade) ListenControl(addr string) error {
+	var l net.Listener
+	var err error
+	loopback := true
+	if strings.HasPrefix(addr, "unix:") {
+		// only accessible by the current user, like pipeListen
+		l, err = listenUnix(addr[len("unix:"):])
+	} else {
+		var host string
+		if host, _, err = net.SplitHostPort(addr); err != nil {
+			return err
+		}
+		loopback = isLoopbackHost(host)
+		if !loopback && f.secret == "" {
+			return errors.New("control api on a non-loopback address needs a secret")
+		}
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	s := &controlServer{f: f, l: l, loopback: loopback, ids: make(map[*lua.LState]int), nextId: 1}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/states", s.handleStates)
+	mux.HandleFunc("/breakpoints", s.handleBreakpoints)
+	mux.HandleFunc("/stacks", s.handleStacks)
+	mux.HandleFunc("/eval", s.handleEval)
+	mux.HandleFunc("/action", s.handleAction)
+	s.srv = &http.Server{Handler: s.authorize(mux)}
+	f.control = s
+
+	go func() {
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed && !f.isClosed() {
+			log.Println("serve control api fail:", err)
+		}
+	}()
+	return nil
+}
+
+func (f *Facade) closeControl() {
+	if f.control != nil {
+		_ = f.control.srv.Close()
+	}
+}
+
+func (s *controlServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a web page may reach a loopback address through DNS rebinding, the
+		// Host is the name of the page then
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if s.loopback && !isLoopbackHost(host) {
+			writeControlError(w, http.StatusForbidden, errors.New("invalid host"))
+			return
+		}
+		// a web page can post a form or text/plain without a CORS preflight,
+		// but not json
+		if r.Method == http.MethodPost {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				writeControlError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+				return
+			}
+		}
+		if s.f.secret != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.f.secret)) != 1 {
+				writeControlError(w, http.StatusUnauthorized, errors.New("invalid secret"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeControlJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("write control rsp fail:", err)
+	}
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(controlError{Error: err.Error()})
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeControlError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+// stateId returns the id of L in the control API, the ids are not reused
+func (s *controlServer) stateId(L *lua.LState) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	id, ok := s.ids[L]
+	if !ok {
+		id = s.nextId
+		s.nextId++
+		s.ids[L] = id
+	}
+	return id
+}
+
+func (s *controlServer) handleStates(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	d := s.f.dbg
+	d.mutexAttach.Lock()
+	var attached []*lua.LState
+	for L := range d.States {
+		attached = append(attached, L)
+	}
+	d.mutexAttach.Unlock()
+
+	states := []ControlState{}
+	for _, L := range attached {
+		states = append(states, ControlState{Id: s.stateId(L), Stopped: d.isBreakingAt(L)})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Id < states[j].Id
+	})
+	writeControlJSON(w, states)
+}
+
+func (s *controlServer) handleBreakpoints(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	d := s.f.dbg
+
+	switch r.Method {
+	case http.MethodGet:
+		bps := []proto.BreakPoint{}
+		for _, bp := range d.GetBreakPoints() {
+			bps = append(bps, proto.BreakPoint{File: bp.File, Line: bp.Line, Condition: bp.Condition})
+		}
+		writeControlJSON(w, bps)
+	case http.MethodPost:
+		var bp proto.BreakPoint
+		if err := json.NewDecoder(r.Body).Decode(&bp); err != nil {
+			writeControlError(w, http.StatusBadRequest, err)
+			return
+		}
+		b := &BreakPoint{File: bp.File, Line: bp.Line, Condition: bp.Condition}
+		if err := checkBreakPoint(b); err != nil {
+			writeControlError(w, http.StatusBadRequest, err)
+			return
+		}
+		d.AddBreakPoint(b)
+		writeControlJSON(w, bp)
+	case http.MethodDelete:
+		query := r.URL.Query()
+		if query.Get("file") == "" && query.Get("line") == "" {
+			d.RemoveAllBreakpoints()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		line, err := strconv.Atoi(query.Get("line"))
+		if err != nil || query.Get("file") == "" {
+			writeControlError(w, http.StatusBadRequest, errors.New("file and line are required"))
+			return
+		}
+		if !d.RemoveBreakPoint(query.Get("file"), line) {
+			writeControlError(w, http.StatusNotFound, errors.New("no breakpoint at "+query.Get("file")+":"+query.Get("line")))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *controlServer) handleStacks(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	stacks, err := s.f.dbg.CurrentStacks()
+	if err != nil {
+		writeControlError(w, http.StatusConflict, err)
+		return
+	}
+	res := []proto.Stack{}
+	for _, stack := range stacks {
+		res = append(res, stack.toProto())
+	}
+	writeControlJSON(w, res)
+}
+
+func (s *controlServer) handleEval(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req controlEvalReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Expr == "" {
+		writeControlError(w, http.StatusBadRequest, errors.New("expr is required"))
+		return
+	}
+	if req.Depth <= 0 {
+		req.Depth = 1
+	}
+
+	results := make(chan *EvalContext, 1)
+	ctx := &EvalContext{
+		Expr:       req.Expr,
+		StackLevel: req.Level,
+		Depth:      req.Depth,
+		done: func(ctx *EvalContext) {
+			results <- ctx
+		},
+	}
+	if err := s.f.dbg.Eval(ctx); err != nil {
+		writeControlError(w, http.StatusConflict, err)
+		return
+	}
+
+	select {
+	case ctx := <-results:
+		if !ctx.Success {
+			if ctx.Error == "" {
+				ctx.Error = "eval fail"
+			}
+			writeControlError(w, http.StatusUnprocessableEntity, errors.New(ctx.Error))
+			return
+		}
+		writeControlJSON(w, ctx.Result.toProto())
+	case <-time.After(controlEvalTimeout):
+		writeControlError(w, http.StatusGatewayTimeout, errors.New("eval timeout"))
+	}
+}
+
+func (s *controlServer) handleAction(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var req controlActionReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	action, ok := controlActions[req.Action]
+	if !ok {
+		writeControlError(w, http.StatusBadRequest, errors.New("unknown action "+strconv.Quote(req.Action)))
+		return
+	}
+
+	if err := s.f.dbg.DoAction(action); err != nil {
+		writeControlError(w, http.StatusConflict, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
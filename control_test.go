@@ -0,0 +1,168 @@
+package lua_debugger
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	lua "github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControl(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	ide.Send(proto.MsgIdAuthReq, proto.AuthReq{Secret: "s3cret"})
+	ide.start(nil, proto.BreakPoint{File: "test.lua", Line: 3})
+
+	L := lua.NewState()
+	defer L.Close()
+	done := runTestScript(t, L, dbgSide, &Options{ControlAddr: "127.0.0.1:0", Secret: "s3cret"})
+	if rsp := ide.expect(&proto.AuthRsp{}).(*proto.AuthRsp); !rsp.Success {
+		t.Fatal("unexpected auth rsp", rsp)
+	}
+	ide.expectStarted()
+	ide.expectBreak()
+	base := "http://" + getFacade(L).control.l.Addr().String()
+
+	call := func(method, path string, body interface{}, status int, rsp interface{}) {
+		var data []byte
+		if body != nil {
+			data, _ = json.Marshal(body)
+		}
+		req, _ := http.NewRequest(method, base+path, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != status {
+			var e controlError
+			_ = json.NewDecoder(res.Body).Decode(&e)
+			t.Fatal(method, path, "unexpected status", res.StatusCode, e.Error)
+		}
+		if rsp != nil {
+			if err := json.NewDecoder(res.Body).Decode(rsp); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if res, err := http.Get(base + "/states"); err != nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatal("secret not checked", err)
+	}
+
+	// a web page can't drive the API
+	req, _ := http.NewRequest("POST", base+"/eval", bytes.NewReader([]byte(`{"expr":"os.exit()"}`)))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	req.Header.Set("Content-Type", "text/plain")
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatal("content type not checked", err)
+	}
+	req, _ = http.NewRequest("GET", base+"/states", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	req.Host = "attacker.example:9968"
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusForbidden {
+		t.Fatal("host not checked", err)
+	}
+
+	var states []ControlState
+	call("GET", "/states", nil, http.StatusOK, &states)
+	if len(states) != 1 || !states[0].Stopped {
+		t.Fatal("unexpected states", states)
+	}
+
+	var stacks []proto.Stack
+	call("GET", "/stacks", nil, http.StatusOK, &stacks)
+	level := -1
+	for _, stack := range stacks {
+		if stack.File == "test.lua" && stack.Line == 3 {
+			level = stack.Level
+		}
+	}
+	if level < 0 {
+		t.Fatal("unexpected stacks", stacks)
+	}
+
+	var value proto.Variable
+	call("POST", "/eval", controlEvalReq{Expr: "a + 1", Level: level}, http.StatusOK, &value)
+	if value.Value != "2" {
+		t.Fatal("unexpected eval result", value)
+	}
+	call("POST", "/eval", controlEvalReq{Expr: "nil + 1", Level: level}, http.StatusUnprocessableEntity, nil)
+	// the IDE sees the failure in the log
+	if notify := ide.expect(&proto.LogNotify{}).(*proto.LogNotify); notify.Type != proto.LogWarning {
+		t.Fatal("unexpected log notify", notify)
+	}
+
+	call("POST", "/breakpoints", proto.BreakPoint{File: "test.lua", Line: 4}, http.StatusOK, nil)
+	call("DELETE", "/breakpoints?file=test.lua&line=3", nil, http.StatusNoContent, nil)
+	var bps []proto.BreakPoint
+	call("GET", "/breakpoints", nil, http.StatusOK, &bps)
+	if len(bps) != 1 || bps[0].Line != 4 {
+		t.Fatal("unexpected breakpoints", bps)
+	}
+
+	call("POST", "/action", controlActionReq{Action: "continue"}, http.StatusNoContent, nil)
+	notify := ide.expectBreak()
+	for _, stack := range notify.Stacks {
+		if stack.File == "test.lua" && stack.Line != 4 {
+			t.Fatal("break at wrong line", stack.Line)
+		}
+	}
+
+	call("DELETE", "/breakpoints", nil, http.StatusNoContent, nil)
+	call("POST", "/action", controlActionReq{Action: "continue"}, http.StatusNoContent, nil)
+	expectScriptDone(t, L, done)
+	call("GET", "/stacks", nil, http.StatusConflict, nil)
+	call("POST", "/action", controlActionReq{Action: "stepIn"}, http.StatusConflict, nil)
+}
+
+func TestControl_Unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emmy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a file which is not a socket is kept
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := newFacade()
+	defer f.Close()
+	if err := f.ListenControl("unix:" + path); err == nil {
+		t.Fatal("file replaced by the socket")
+	}
+
+	path = filepath.Join(dir, "control.sock")
+	if err := f.ListenControl("unix:" + path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatal("unexpected socket permission", info.Mode().Perm())
+	}
+}
+
+func TestControl_NonLoopback(t *testing.T) {
+	f := newFacade()
+	defer f.Close()
+	if err := f.ListenControl("0.0.0.0:0"); err == nil {
+		t.Fatal("non-loopback address accepted without a secret")
+	}
+	f.secret = "s3cret"
+	if err := f.ListenControl("0.0.0.0:0"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,645 @@
+package lua_debugger
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// the only thread reported to the DAP client, the emmy protocol has no
+// threads
+const dapThreadId = 1
+
+var luaIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// DapTransport is a Transport speaking the Debug Adapter Protocol to a
+// client like VS Code or nvim-dap. The DAP requests are turned into the
+// emmy messages for the Facade, and the emmy messages from the Facade into
+// the DAP responses and events
+type DapTransport struct {
+	emmyAdapter
+
+	c      net.Conn
+	l      net.Listener
+	closed int32
+
+	// guards the writes and everything below
+	m           sync.Mutex
+	seq         int
+	emmySeq     int
+	pending     map[int]*dapPending
+	stacks      []proto.Stack
+	refs        []*dapRef
+	breakpoints map[string][]proto.BreakPoint
+	stopReason  string
+}
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// dapRef is a variablesReference, the children are loaded with an eval of
+// expr if they're not in the break notification
+type dapRef struct {
+	vars  []*proto.Variable
+	expr  string
+	level int
+}
+
+// dapPending is a DAP request waiting for the EvalRsp of the Facade
+type dapPending struct {
+	req   *dapRequest
+	ref   *dapRef
+	level int
+}
+
+func NewDapTransport() *DapTransport {
+	return &DapTransport{
+		pending:     make(map[int]*dapPending),
+		breakpoints: make(map[string][]proto.BreakPoint),
+	}
+}
+
+// Listen waits for the DAP client on host:port and serves the first one
+func (t *DapTransport) Listen(host string, port int) error {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	t.l = l
+
+	go func() {
+		c, err := l.Accept()
+		_ = l.Close()
+		if err != nil {
+			if !t.isClosed() {
+				log.Println("accept dap client fail:", err)
+			}
+			return
+		}
+		t.m.Lock()
+		t.c = c
+		t.m.Unlock()
+		t.serve()
+	}()
+	return nil
+}
+
+// Close tells the client the session is terminated and closes the
+// connection, the handler won't be notified
+func (t *DapTransport) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	if t.l != nil {
+		_ = t.l.Close()
+	}
+	t.event("terminated", nil)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.c != nil {
+		return t.c.Close()
+	}
+	return nil
+}
+
+func (t *DapTransport) isClosed() bool {
+	return atomic.LoadInt32(&t.closed) != 0
+}
+
+func (t *DapTransport) serve() {
+	r := bufio.NewReader(t.c)
+	for {
+		data, err := readDapMsg(r)
+		if err != nil {
+			if err != io.EOF && !t.isClosed() {
+				log.Println("read dap msg fail:", err)
+			}
+			break
+		}
+
+		var req dapRequest
+		if err := json.Unmarshal(data, &req); err != nil || req.Type != "request" {
+			log.Println("invalid dap msg:", string(data))
+			continue
+		}
+		t.handleRequest(&req)
+	}
+
+	_ = t.c.Close()
+	if !t.isClosed() {
+		t.request(proto.MsgIdActionReq, &proto.ActionReq{Action: proto.Stop}, proto.MsgIdActionRsp, nil)
+	}
+}
+
+// readDapMsg reads the content of a message, which is after the
+// Content-Length header and an empty line
+func readDapMsg(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if i := strings.Index(line, ":"); i >= 0 && strings.EqualFold(line[:i], "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[i+1:]))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if length < 0 || length > DefaultMaxFrameSize {
+		return nil, fmt.Errorf("invalid content length %d", length)
+	}
+
+	data := make([]byte, length)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+func (t *DapTransport) write(msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("send dap msg fail:", err)
+		return
+	}
+	if t.c == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(t.c, "Content-Length: %d\r\n\r\n%s", len(data), data); err != nil && !t.isClosed() {
+		log.Println("send dap msg fail:", err)
+	}
+}
+
+func (t *DapTransport) respond(req *dapRequest, body interface{}, err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.seq++
+	rsp := dapResponse{Seq: t.seq, Type: "response", RequestSeq: req.Seq, Success: err == nil, Command: req.Command, Body: body}
+	if err != nil {
+		rsp.Message = err.Error()
+	}
+	t.write(rsp)
+}
+
+func (t *DapTransport) event(name string, body interface{}) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.seq++
+	t.write(dapEvent{Seq: t.seq, Type: "event", Event: name, Body: body})
+}
+
+func (t *DapTransport) handleRequest(req *dapRequest) {
+	switch req.Command {
+	case "initialize":
+		t.emmy(proto.MsgIdInitReq, &proto.InitReq{Ext: []string{".lua"}})
+		t.respond(req, map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsEvaluateForHovers":        true,
+		}, nil)
+		t.event("initialized", nil)
+	case "launch", "attach":
+		// the debuggee is already running
+		t.respond(req, nil, nil)
+	case "setBreakpoints":
+		t.onSetBreakpoints(req)
+	case "configurationDone":
+		t.emmy(proto.MsgIdReadyReq, &proto.ReadyReq{})
+		t.respond(req, nil, nil)
+	case "threads":
+		t.respond(req, map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": dapThreadId, "name": "lua"}},
+		}, nil)
+	case "stackTrace":
+		t.onStackTrace(req)
+	case "scopes":
+		t.onScopes(req)
+	case "variables":
+		t.onVariables(req)
+	case "evaluate":
+		t.onEvaluate(req)
+	case "continue":
+		t.action(req, proto.Continue, "")
+	case "next":
+		t.action(req, proto.StepOver, "step")
+	case "stepIn":
+		t.action(req, proto.StepIn, "step")
+	case "stepOut":
+		t.action(req, proto.StepOut, "step")
+	case "pause":
+		t.action(req, proto.Break, "pause")
+	case "disconnect", "terminate":
+		t.respond(req, nil, nil)
+		t.request(proto.MsgIdActionReq, &proto.ActionReq{Action: proto.Stop}, proto.MsgIdActionRsp, nil)
+	default:
+		t.respond(req, nil, errors.New("unsupported request: "+req.Command))
+	}
+}
+
+// action responds when the Facade answers, the stopped event of a break
+// right after the action is sent after the response
+func (t *DapTransport) action(req *dapRequest, action proto.DebugAction, stopReason string) {
+	t.m.Lock()
+	t.stopReason = stopReason
+	// the stacks and variables references are only valid while stopped
+	stacks, refs := t.stacks, t.refs
+	t.stacks = nil
+	t.refs = nil
+	t.m.Unlock()
+
+	t.request(proto.MsgIdActionReq, &proto.ActionReq{Action: action}, proto.MsgIdActionRsp, func(success bool, err string) {
+		if !success {
+			// still stopped where it was
+			t.m.Lock()
+			if t.stacks == nil {
+				t.stacks, t.refs = stacks, refs
+			}
+			t.stopReason = ""
+			t.m.Unlock()
+			t.respond(req, nil, errors.New(err))
+		} else if action == proto.Continue {
+			t.respond(req, map[string]interface{}{"allThreadsContinued": true}, nil)
+		} else {
+			t.respond(req, nil, nil)
+		}
+	})
+}
+
+func (t *DapTransport) onSetBreakpoints(req *dapRequest) {
+	var args struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line      int    `json:"line"`
+			Condition string `json:"condition"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		t.respond(req, nil, err)
+		return
+	}
+
+	// the breakpoints of the source are replaced
+	var bps []proto.BreakPoint
+	for _, bp := range args.Breakpoints {
+		bps = append(bps, proto.BreakPoint{File: args.Source.Path, Line: bp.Line, Condition: bp.Condition})
+	}
+	t.m.Lock()
+	old := t.breakpoints[args.Source.Path]
+	t.breakpoints[args.Source.Path] = bps
+	t.m.Unlock()
+
+	if len(old) > 0 {
+		t.emmy(proto.MsgIdRemoveBreakPointReq, &proto.RemoveBreakPointReq{BreakPoints: old})
+	}
+	result := make([]map[string]interface{}, len(bps))
+	if len(bps) == 0 {
+		t.respond(req, map[string]interface{}{"breakpoints": result}, nil)
+		return
+	}
+	// one by one to know which are verified, the Facade answers in order
+	for i, bp := range bps {
+		i, line := i, bp.Line
+		t.request(proto.MsgIdAddBreakPointReq, &proto.AddBreakPointReq{BreakPoints: []proto.BreakPoint{bp}},
+			proto.MsgIdAddBreakPointRsp, func(success bool, err string) {
+				result[i] = map[string]interface{}{"verified": success, "line": line}
+				if !success {
+					result[i]["message"] = err
+				}
+				if i == len(bps)-1 {
+					t.respond(req, map[string]interface{}{"breakpoints": result}, nil)
+				}
+			})
+	}
+}
+
+func (t *DapTransport) onStackTrace(req *dapRequest) {
+	t.m.Lock()
+	var frames []map[string]interface{}
+	for _, stack := range t.stacks {
+		// the go functions, e.g. the hook, can't be shown
+		if stack.Line < 0 {
+			continue
+		}
+		name := stack.FunctionName
+		if name == "" {
+			name = "?"
+		}
+		frames = append(frames, map[string]interface{}{
+			"id":     stack.Level + 1,
+			"name":   name,
+			"source": map[string]interface{}{"name": filepath.Base(stack.File), "path": dapPath(stack.File)},
+			"line":   stack.Line,
+			"column": 1,
+		})
+	}
+	t.m.Unlock()
+
+	t.respond(req, map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil)
+}
+
+// dapPath returns the absolute path of file if it's found, so the client can
+// open it
+func dapPath(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		if _, err := os.Stat(abs); err == nil {
+			return abs
+		}
+	}
+	return file
+}
+
+func (t *DapTransport) onScopes(req *dapRequest) {
+	var args struct {
+		FrameId int `json:"frameId"`
+	}
+	_ = json.Unmarshal(req.Arguments, &args)
+
+	t.m.Lock()
+	var scopes []map[string]interface{}
+	for _, stack := range t.stacks {
+		if stack.Level+1 == args.FrameId {
+			ref := t.newRef(&dapRef{vars: stack.LocalVariables, level: stack.Level})
+			scopes = append(scopes, map[string]interface{}{
+				"name":               "Locals",
+				"variablesReference": ref,
+				"expensive":          false,
+			})
+		}
+	}
+	t.m.Unlock()
+
+	if scopes == nil {
+		t.respond(req, nil, errors.New("invalid frame"))
+		return
+	}
+	t.respond(req, map[string]interface{}{"scopes": scopes}, nil)
+}
+
+func (t *DapTransport) newRef(ref *dapRef) int {
+	t.refs = append(t.refs, ref)
+	return len(t.refs)
+}
+
+func (t *DapTransport) onVariables(req *dapRequest) {
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	_ = json.Unmarshal(req.Arguments, &args)
+
+	t.m.Lock()
+	if args.VariablesReference < 1 || args.VariablesReference > len(t.refs) {
+		t.m.Unlock()
+		t.respond(req, nil, errors.New("invalid variables reference"))
+		return
+	}
+	ref := t.refs[args.VariablesReference-1]
+	if ref.vars == nil && ref.expr != "" {
+		// load the fields of the table
+		t.m.Unlock()
+		t.eval(req, ref, ref.expr, ref.level)
+		return
+	}
+	variables := t.dapVariables(ref)
+	t.m.Unlock()
+
+	t.respond(req, map[string]interface{}{"variables": variables}, nil)
+}
+
+// dapVariables converts the children of ref, the tables get a reference
+func (t *DapTransport) dapVariables(ref *dapRef) []dapVariable {
+	variables := []dapVariable{}
+	for _, v := range ref.vars {
+		dv := dapVariable{Name: v.Name, Value: dapValue(v), Type: v.ValueTypeName}
+		if v.ValueType == LUA_TTABLE {
+			dv.VariablesReference = t.newRef(&dapRef{vars: v.Children, expr: childExpr(ref.expr, v), level: ref.level})
+		}
+		variables = append(variables, dv)
+	}
+	return variables
+}
+
+func dapValue(v *proto.Variable) string {
+	switch v.ValueType {
+	case LUA_TTABLE:
+		return "table"
+	case LUA_TSTRING:
+		return strconv.Quote(v.Value)
+	}
+	return v.Value
+}
+
+// childExpr returns the lua expression of the field v of parent, or "" if
+// the key can't be written
+func childExpr(parent string, v *proto.Variable) string {
+	if parent == "" {
+		return v.Name
+	}
+	switch v.NameType {
+	case LUA_TSTRING:
+		if luaIdentifier.MatchString(v.Name) {
+			return parent + "." + v.Name
+		}
+		return parent + "[" + strconv.Quote(v.Name) + "]"
+	case LUA_TNUMBER, LUA_TBOOLEAN:
+		return parent + "[" + v.Name + "]"
+	}
+	return ""
+}
+
+func (t *DapTransport) onEvaluate(req *dapRequest) {
+	var args struct {
+		Expression string `json:"expression"`
+		FrameId    int    `json:"frameId"`
+	}
+	_ = json.Unmarshal(req.Arguments, &args)
+
+	level := args.FrameId - 1
+	if level < 0 {
+		// the top lua frame
+		t.m.Lock()
+		for _, stack := range t.stacks {
+			if stack.Line >= 0 {
+				level = stack.Level
+				break
+			}
+		}
+		t.m.Unlock()
+	}
+	t.eval(req, nil, args.Expression, level)
+}
+
+// eval sends an EvalReq to the Facade, the DAP request is answered when the
+// EvalRsp comes. ref is the reference to load, nil for an evaluate request
+func (t *DapTransport) eval(req *dapRequest, ref *dapRef, expr string, level int) {
+	t.m.Lock()
+	if t.stacks == nil {
+		// the Facade only evaluates at a break
+		t.m.Unlock()
+		t.respond(req, nil, errors.New("not stopped"))
+		return
+	}
+	t.emmySeq++
+	seq := t.emmySeq
+	t.pending[seq] = &dapPending{req: req, ref: ref, level: level}
+	t.m.Unlock()
+
+	t.emmy(proto.MsgIdEvalReq, &proto.EvalReq{Seq: seq, Expr: expr, StackLevel: level, Depth: 1})
+}
+
+// Send handles the messages from the Facade
+func (t *DapTransport) Send(cmd int, msg interface{}) {
+	// the messages may be either values or pointers, get the same type as
+	// a transport would
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("send msg fail:", err)
+		return
+	}
+	typed := proto.GetMsg(cmd)
+	if typed == nil || json.Unmarshal(data, typed) != nil {
+		return
+	}
+
+	switch m := typed.(type) {
+	case *proto.AddBreakPointRsp:
+		t.answers.answer(cmd, m.Success, m.Error)
+	case *proto.ActionRsp:
+		t.answers.answer(cmd, m.Success, m.Error)
+	case *proto.BreakNotify:
+		t.answers.after(proto.MsgIdActionRsp, func() {
+			t.m.Lock()
+			t.stacks = m.Stacks
+			t.refs = nil
+			reason := t.stopReason
+			t.stopReason = ""
+			t.m.Unlock()
+			if reason == "" {
+				reason = "breakpoint"
+			}
+			t.event("stopped", map[string]interface{}{
+				"reason":            reason,
+				"threadId":          dapThreadId,
+				"allThreadsStopped": true,
+			})
+		})
+	case *proto.EvalRsp:
+		t.onEvalRsp(m)
+	case *proto.ErrorNotify:
+		t.event("output", map[string]interface{}{
+			"category": "stderr",
+			"output":   fmt.Sprintf("debugger: msg %d dropped: %s\n", m.Cmd, m.Error),
+		})
+	case *proto.LogNotify:
+		t.event("output", dapOutput(m))
+	}
+}
+
+// dapOutput is the body of the output event of a LogNotify
+func dapOutput(m *proto.LogNotify) map[string]interface{} {
+	if !m.Output {
+		category := "console"
+		if m.Type != proto.LogInfo {
+			category = "stderr"
+		}
+		return map[string]interface{}{"category": category, "output": "debugger: " + m.Message + "\n"}
+	}
+
+	body := map[string]interface{}{"category": "stdout", "output": m.Message}
+	if m.File != "" {
+		body["source"] = map[string]interface{}{"name": filepath.Base(m.File), "path": m.File}
+		body["line"] = m.Line
+	}
+	return body
+}
+
+func (t *DapTransport) onEvalRsp(rsp *proto.EvalRsp) {
+	t.m.Lock()
+	pending := t.pending[rsp.Seq]
+	delete(t.pending, rsp.Seq)
+	if pending == nil {
+		t.m.Unlock()
+		return
+	}
+	if !rsp.Success || rsp.Value == nil {
+		t.m.Unlock()
+		t.respond(pending.req, nil, errors.New(rsp.Error))
+		return
+	}
+
+	if pending.ref != nil {
+		pending.ref.vars = rsp.Value.Children
+		if pending.ref.vars == nil {
+			pending.ref.vars = []*proto.Variable{}
+		}
+		variables := t.dapVariables(pending.ref)
+		t.m.Unlock()
+		t.respond(pending.req, map[string]interface{}{"variables": variables}, nil)
+		return
+	}
+
+	// the result of an evaluate request
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	_ = json.Unmarshal(pending.req.Arguments, &args)
+	ref := 0
+	if rsp.Value.ValueType == LUA_TTABLE {
+		ref = t.newRef(&dapRef{vars: rsp.Value.Children, expr: args.Expression, level: pending.level})
+	}
+	t.m.Unlock()
+	t.respond(pending.req, map[string]interface{}{
+		"result":             dapValue(rsp.Value),
+		"type":               rsp.Value.ValueTypeName,
+		"variablesReference": ref,
+	}, nil)
+}
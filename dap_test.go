@@ -0,0 +1,188 @@
+package lua_debugger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	lua "github.com/yuin/gopher-lua"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type dapTestMsg struct {
+	Type       string          `json:"type"`
+	Command    string          `json:"command"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+func TestDapTransport(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	addrs := make(chan net.Addr, 1)
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		fcd := registerFacade(L)
+		trans := NewDapTransport()
+		err := fcd.start(L, trans, nil, func() error {
+			err := trans.Listen("127.0.0.1", 0)
+			if err == nil {
+				addrs <- trans.l.Addr()
+			}
+			return err
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+	done := make(chan error, 1)
+	go func() {
+		fn, err := L.Load(strings.NewReader(testScript), "test.lua")
+		if err == nil {
+			L.Push(fn)
+			err = L.PCall(0, 0, nil)
+		}
+		done <- err
+	}()
+
+	var addr net.Addr
+	select {
+	case addr = <-addrs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dap not listening")
+	}
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	msgs := readDapTestMsgs(c)
+
+	seq := 0
+	send := func(command string, args interface{}) *dapTestMsg {
+		seq++
+		data, _ := json.Marshal(map[string]interface{}{
+			"seq": seq, "type": "request", "command": command, "arguments": args,
+		})
+		_, _ = fmt.Fprintf(c, "Content-Length: %d\r\n\r\n%s", len(data), data)
+		return expectDapMsg(t, msgs, func(m *dapTestMsg) bool {
+			return m.Type == "response" && m.RequestSeq == seq
+		})
+	}
+	request := func(command string, args interface{}) *dapTestMsg {
+		rsp := send(command, args)
+		if !rsp.Success {
+			t.Fatal(command, "fail:", rsp.Message)
+		}
+		return rsp
+	}
+
+	request("initialize", map[string]interface{}{"adapterID": "lua"})
+	expectDapMsg(t, msgs, func(m *dapTestMsg) bool { return m.Event == "initialized" })
+	request("attach", nil)
+	var breakpoints struct {
+		Breakpoints []struct {
+			Verified bool   `json:"verified"`
+			Message  string `json:"message"`
+		} `json:"breakpoints"`
+	}
+	_ = json.Unmarshal(request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": "/src/test.lua"},
+		"breakpoints": []map[string]interface{}{{"line": 3}, {"line": 4, "condition": "a +"}},
+	}).Body, &breakpoints)
+	if len(breakpoints.Breakpoints) != 2 || !breakpoints.Breakpoints[0].Verified ||
+		breakpoints.Breakpoints[1].Verified || breakpoints.Breakpoints[1].Message == "" {
+		t.Fatal("unexpected breakpoints", breakpoints)
+	}
+	if rsp := send("next", map[string]interface{}{"threadId": 1}); rsp.Success {
+		t.Fatal("stepped while running")
+	}
+	request("configurationDone", nil)
+	expectDapMsg(t, msgs, func(m *dapTestMsg) bool { return m.Event == "stopped" })
+
+	var trace struct {
+		StackFrames []struct {
+			Id   int `json:"id"`
+			Line int `json:"line"`
+		} `json:"stackFrames"`
+	}
+	_ = json.Unmarshal(request("stackTrace", map[string]interface{}{"threadId": 1}).Body, &trace)
+	if len(trace.StackFrames) == 0 || trace.StackFrames[0].Line != 3 {
+		t.Fatal("unexpected stack trace", trace)
+	}
+	frameId := trace.StackFrames[0].Id
+
+	var scopes struct {
+		Scopes []struct {
+			VariablesReference int `json:"variablesReference"`
+		} `json:"scopes"`
+	}
+	_ = json.Unmarshal(request("scopes", map[string]interface{}{"frameId": frameId}).Body, &scopes)
+	if len(scopes.Scopes) != 1 {
+		t.Fatal("unexpected scopes", scopes)
+	}
+	var variables struct {
+		Variables []dapVariable `json:"variables"`
+	}
+	_ = json.Unmarshal(request("variables", map[string]interface{}{
+		"variablesReference": scopes.Scopes[0].VariablesReference,
+	}).Body, &variables)
+	if len(variables.Variables) != 1 || variables.Variables[0].Name != "a" || variables.Variables[0].Value != "1" {
+		t.Fatal("unexpected variables", variables)
+	}
+
+	var result struct {
+		Result string `json:"result"`
+	}
+	_ = json.Unmarshal(request("evaluate", map[string]interface{}{"expression": "a + 1", "frameId": frameId}).Body, &result)
+	if result.Result != "2" {
+		t.Fatal("unexpected evaluate result", result)
+	}
+
+	request("continue", map[string]interface{}{"threadId": 1})
+	expectScriptDone(t, L, done)
+	request("disconnect", nil)
+	expectDapMsg(t, msgs, func(m *dapTestMsg) bool { return m.Event == "terminated" })
+}
+
+func readDapTestMsgs(c net.Conn) <-chan *dapTestMsg {
+	msgs := make(chan *dapTestMsg, 64)
+	go func() {
+		r := bufio.NewReader(c)
+		for {
+			data, err := readDapMsg(r)
+			if err != nil {
+				close(msgs)
+				return
+			}
+			var msg dapTestMsg
+			if err := json.Unmarshal(data, &msg); err == nil {
+				msgs <- &msg
+			}
+		}
+	}()
+	return msgs
+}
+
+// expectDapMsg returns the first msg matching match, the others are skipped
+func expectDapMsg(t *testing.T, msgs <-chan *dapTestMsg, match func(m *dapTestMsg) bool) *dapTestMsg {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				t.Fatal("dap connection closed")
+			}
+			if match(msg) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatal("dap msg not received")
+		}
+	}
+}
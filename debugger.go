@@ -2,8 +2,11 @@ package lua_debugger
 
 import (
 	"container/list"
+	"errors"
+	"fmt"
 	"github.com/edolphin-ydf/gopherlua-debugger/proto"
 	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
 	"log"
 	"strings"
 	"sync"
@@ -26,10 +29,13 @@ func Hook(L *lua.LState) int {
 		ar.Event = Lua_HookRet
 	}
 
-	if fcdUd, ok := L.GetField(L.Get(lua.RegistryIndex), KeyDebuggerFcd).(*lua.LUserData); ok {
-		if fcd, ok := fcdUd.Value.(*Facade); ok {
-			fcd.dbg.Hook(L, ar)
+	if fcd := getFacade(L); fcd != nil {
+		if fcd.isClosed() {
+			// closed on another goroutine, finish the detach here
+			fcd.detach(L)
+			return 0
 		}
+		fcd.dbg.Hook(L, ar)
 	}
 	return 0
 }
@@ -45,12 +51,14 @@ type Debugger struct {
 	HookState    HookStateInter
 
 	stateBreak    HookStateInter
-	stateStepOver HookStateInter
-	stateStepIn   HookStateInter
-	stateStepOut  HookStateInter
 	stateContinue HookStateInter
 	stateStop     HookStateInter
 
+	// guards SkipHook, HookState, HelperCode, running and evaluating, the
+	// hooks of all the states read them while the IDE changes them
+	mutexHook  sync.Mutex
+	evaluating map[*lua.LState]struct{}
+
 	mutexBP   sync.Mutex
 	mutexRun  sync.Mutex
 	condRun   *sync.Cond
@@ -59,6 +67,12 @@ type Debugger struct {
 	evalQueue list.List
 	running   bool
 
+	mutexAttach   sync.Mutex
+	pendingAttach map[*lua.LState]struct{}
+	skipLine      map[*lua.LState]int
+	// only one state breaks at a time, the others wait for it
+	mutexBreak sync.Mutex
+
 	fcd *Facade
 }
 
@@ -66,33 +80,65 @@ func newDebugger() *Debugger {
 	res := &Debugger{}
 	res.LineSet = make(map[int]struct{})
 	res.States = make(map[*lua.LState]struct{})
+	res.pendingAttach = make(map[*lua.LState]struct{})
+	res.skipLine = make(map[*lua.LState]int)
+	res.evaluating = make(map[*lua.LState]struct{})
 	res.condRun = sync.NewCond(&res.mutexRun)
 	res.stateBreak = &HookStateBreak{}
-	res.stateStepOver = &HookStateStepOver{}
-	res.stateStepIn = &HookStateStepIn{}
-	res.stateStepOut = &HookStateStepOut{}
 	res.stateContinue = &HookStateContinue{}
 	res.stateStop = &HookStateStop{}
 	return res
 }
 
+// logln logs the diagnostic like log.Println, and sends it to the IDE
+func (d *Debugger) logln(logType proto.LogType, args ...interface{}) {
+	msg := fmt.Sprintln(args...)
+	_ = log.Output(2, msg)
+	if d.fcd != nil {
+		d.fcd.sendLog(&proto.LogNotify{Type: logType, Message: strings.TrimSuffix(msg, "\n")})
+	}
+}
+
 func (d *Debugger) Start(code string) {
+	d.mutexHook.Lock()
 	d.HelperCode = code
 	d.SkipHook = false
-	d.blocking = false
 	d.running = true
+	d.mutexHook.Unlock()
+
+	d.mutexRun.Lock()
+	d.blocking = false
+	d.mutexRun.Unlock()
+}
+
+func (d *Debugger) Stop() {
+	d.mutexHook.Lock()
+	d.running = false
+	d.SkipHook = true
+	d.mutexHook.Unlock()
+}
+
+func (d *Debugger) isRunning() bool {
+	d.mutexHook.Lock()
+	defer d.mutexHook.Unlock()
+	return d.running
 }
 
 func (d *Debugger) Attach(L *lua.LState) {
-	if !d.running {
+	d.mutexHook.Lock()
+	running, helperCode := d.running, d.HelperCode
+	d.mutexHook.Unlock()
+	if !running {
 		return
 	}
 
+	d.mutexAttach.Lock()
 	d.States[L] = struct{}{}
+	d.mutexAttach.Unlock()
 
-	if d.HelperCode != "" {
+	if helperCode != "" {
 		t := L.GetTop()
-		err := L.DoString(d.HelperCode)
+		err := L.DoString(helperCode)
 		if err != nil {
 			log.Fatal("do helper code fail:", err)
 		}
@@ -101,31 +147,107 @@ func (d *Debugger) Attach(L *lua.LState) {
 	d.UpdateHook(L, "clr")
 }
 
-func (d *Debugger) DoAction(action proto.DebugAction) {
-	L := d.CurrentState
+// AttachLater attaches L in its next hook, L must have been attached before
+// and may be running on another goroutine
+func (d *Debugger) AttachLater(L *lua.LState) {
+	d.mutexAttach.Lock()
+	d.pendingAttach[L] = struct{}{}
+	d.mutexAttach.Unlock()
+}
+
+func (d *Debugger) takePendingAttach(L *lua.LState) bool {
+	d.mutexAttach.Lock()
+	defer d.mutexAttach.Unlock()
+
+	_, ok := d.pendingAttach[L]
+	delete(d.pendingAttach, L)
+	return ok
+}
+
+func (d *Debugger) Detach(L *lua.LState) {
+	d.mutexAttach.Lock()
+	delete(d.States, L)
+	delete(d.pendingAttach, L)
+	delete(d.skipLine, L)
+	d.mutexAttach.Unlock()
+	d.UpdateHook(L, "")
+}
+
+// DoAction runs the action of the IDE, the actions resuming the state fail
+// if it's not at a break
+func (d *Debugger) DoAction(action proto.DebugAction) error {
+	L := d.currentState()
+	switch action {
+	case proto.Continue, proto.StepOver, proto.StepIn, proto.StepOut:
+		if !d.isBreakingAt(L) {
+			return errors.New("not at a break")
+		}
+	case proto.Break, proto.Stop:
+	default:
+		return fmt.Errorf("unknown action %d", action)
+	}
+
 	switch action {
 	case proto.Break:
 		d.SetHookState(L, d.stateBreak)
 	case proto.Continue:
 		d.SetHookState(L, d.stateContinue)
+	// the steps keep the state and levels of L, which the hooks of the other
+	// states sharing the debugger read, so every step gets its own value
 	case proto.StepOver:
-		d.SetHookState(L, d.stateStepOver)
+		d.SetHookState(L, &HookStateStepOver{})
 	case proto.StepIn:
-		d.SetHookState(L, d.stateStepIn)
+		d.SetHookState(L, &HookStateStepIn{})
 	case proto.StepOut:
-		d.SetHookState(L, d.stateStepOut)
+		d.SetHookState(L, &HookStateStepOut{})
 	case proto.Stop:
 		d.SetHookState(L, d.stateStop)
 	}
+	return nil
 }
 
 func (d *Debugger) SetHookState(L *lua.LState, newState HookStateInter) {
-	d.HookState = nil
+	d.storeHookState(nil)
 	if newState.Start(d, L) {
-		d.HookState = newState
+		d.storeHookState(newState)
 	}
 }
 
+func (d *Debugger) hookState() HookStateInter {
+	d.mutexHook.Lock()
+	defer d.mutexHook.Unlock()
+	return d.HookState
+}
+
+func (d *Debugger) storeHookState(state HookStateInter) {
+	d.mutexHook.Lock()
+	d.HookState = state
+	d.mutexHook.Unlock()
+}
+
+// skipHook reports whether the hooks of L are skipped, when the debugger is
+// stopped or L is running an eval
+func (d *Debugger) skipHook(L *lua.LState) bool {
+	d.mutexHook.Lock()
+	defer d.mutexHook.Unlock()
+	_, evaluating := d.evaluating[L]
+	return d.SkipHook || evaluating
+}
+
+// withoutHook runs fn with the hooks of L skipped, fn runs lua code on L for
+// the debugger, e.g. an eval
+func (d *Debugger) withoutHook(L *lua.LState, fn func()) {
+	d.mutexHook.Lock()
+	d.evaluating[L] = struct{}{}
+	d.mutexHook.Unlock()
+	defer func() {
+		d.mutexHook.Lock()
+		delete(d.evaluating, L)
+		d.mutexHook.Unlock()
+	}()
+	fn()
+}
+
 func (d *Debugger) GetStackLevel(L *lua.LState, skipGo bool) int {
 	level := 0
 	i := 0
@@ -133,7 +255,7 @@ func (d *Debugger) GetStackLevel(L *lua.LState, skipGo bool) int {
 	for ok {
 		_, err := L.GetInfo("l", ar, nil)
 		if err != nil {
-			log.Println("get info fail", err)
+			d.logln(proto.LogError, "get info fail", err)
 			return level
 		}
 
@@ -147,32 +269,80 @@ func (d *Debugger) GetStackLevel(L *lua.LState, skipGo bool) int {
 }
 
 func (d *Debugger) UpdateHook(L *lua.LState, mask string) {
+	// clear first, or the count hook is kept
+	_ = L.SetHook(nil, "", 0)
 	if mask == "" {
-		_ = L.SetHook(L.NewFunction(Hook), mask, 0)
+		return
+	}
+	if _, ok := L.GetStack(0); !ok {
+		// the line hook needs a running function, hook the first instruction
+		// of L instead, the hook will be updated there
+		_ = L.SetHook(L.NewFunction(Hook), "c", 1)
 		return
 	}
 	_ = L.SetHook(L.NewFunction(Hook), mask, 0)
 }
 
 func (d *Debugger) Hook(L *lua.LState, ar *Ar) {
-	if d.SkipHook {
+	if ar.Event == Lua_HookCount {
+		d.upgradeHook(L, ar)
+	} else if ar.Event == Lua_HookLine && d.takeSkipLine(L, ar.CurrentLine) {
+		return
+	}
+	if d.skipHook(L) {
 		return
 	}
+	if d.takePendingAttach(L) {
+		d.Attach(L)
+	}
 	if ar.Event == Lua_HookLine {
 		ar2, _ := L.GetStack(1)
 		ar2.CurrentLine = ar.CurrentLine
 		ar.Debug = *ar2
 		bp := d.FindBreakPoint(L, ar)
-		if bp != nil {
+		if bp != nil && d.checkCondition(L, bp) {
 			d.HandleBreak(L)
 			return
 		}
-		if d.HookState != nil {
-			d.HookState.ProcessHook(d, L, ar)
+		if hookState := d.hookState(); hookState != nil {
+			hookState.ProcessHook(d, L, ar)
 		}
 	}
 }
 
+// upgradeHook replaces the hook set by UpdateHook for a state not running,
+// and turns the event into a line event, the line hook set now would miss it
+func (d *Debugger) upgradeHook(L *lua.LState, ar *Ar) {
+	d.UpdateHook(L, "clr")
+
+	ar2, ok := L.GetStack(1)
+	if !ok {
+		return
+	}
+	if _, err := L.GetInfo("l", ar2, nil); err != nil || ar2.CurrentLine < 0 {
+		return
+	}
+	ar.Event = Lua_HookLine
+	ar.CurrentLine = ar2.CurrentLine
+
+	// the line hook will report the same line once again
+	d.mutexAttach.Lock()
+	d.skipLine[L] = ar.CurrentLine
+	d.mutexAttach.Unlock()
+}
+
+func (d *Debugger) takeSkipLine(L *lua.LState, line int) bool {
+	d.mutexAttach.Lock()
+	defer d.mutexAttach.Unlock()
+
+	skip, ok := d.skipLine[L]
+	if !ok {
+		return false
+	}
+	delete(d.skipLine, L)
+	return skip == line
+}
+
 func GoLuaTypeToCLuaType(t lua.LValueType) (int, string) {
 
 	switch t {
@@ -225,57 +395,136 @@ func (d *Debugger) GetVariable(name string, value lua.LValue, depth int) *Variab
 }
 
 func (d *Debugger) GetStacks(L *lua.LState) []*Stack {
+	return d.getStacks(L, false)
+}
+
+// GetLazyStacks is like GetStacks, but only the top lua frame has the
+// variables, and without the table fields
+func (d *Debugger) GetLazyStacks(L *lua.LState) []*Stack {
+	return d.getStacks(L, true)
+}
+
+func (d *Debugger) getStacks(L *lua.LState, lazy bool) []*Stack {
 	var stacks []*Stack
-	level := 0
-	for {
+	withVariables := true
+	for level := 0; ; level++ {
 		ar, ok := L.GetStack(level)
 		if !ok {
 			break
 		}
 		if _, err := L.GetInfo("nSlu", ar, nil); err != nil {
-			log.Println("Debugger:GetStacks get info fail:", err)
+			d.logln(proto.LogError, "Debugger:GetStacks get info fail:", err)
 			break
 		}
 
-		stack := &Stack{}
-		stack.File = d.GetFile(L, &Ar{Debug: *ar})
-		stack.FunctionName = ar.Name
-		stack.Level = level
-		stack.Line = ar.CurrentLine
+		stack := d.newStack(L, ar, level)
 		stacks = append(stacks, stack)
+		if !lazy {
+			d.getVariables(L, ar, stack, 1)
+		} else if withVariables && ar.CurrentLine >= 0 {
+			d.getVariables(L, ar, stack, 0)
+			withVariables = false
+		}
+	}
+	return stacks
+}
 
-		for i := 1; ; i++ {
-			name, value := L.GetLocal(ar, i)
-			if name == "" {
-				break
-			}
-			if name[0] == '(' {
-				continue
-			}
+// StackAt returns the frame at level of the state blocked at a break, with
+// the variables
+func (d *Debugger) StackAt(level int) (*Stack, error) {
+	var stack *Stack
+	var err error
+	if taskErr := d.runAtBreak(func(L *lua.LState) {
+		ar, ok := L.GetStack(level)
+		if !ok {
+			err = errors.New("invalid stack level")
+			return
+		}
+		if _, err = L.GetInfo("nSlu", ar, nil); err != nil {
+			return
+		}
+		stack = d.newStack(L, ar, level)
+		d.getVariables(L, ar, stack, 1)
+	}); taskErr != nil {
+		return nil, taskErr
+	}
+	return stack, err
+}
+
+// CurrentStacks returns the stacks of the state blocked at a break
+func (d *Debugger) CurrentStacks() ([]*Stack, error) {
+	var stacks []*Stack
+	if err := d.runAtBreak(func(L *lua.LState) {
+		stacks = d.GetStacks(L)
+	}); err != nil {
+		return nil, err
+	}
+	return stacks, nil
+}
+
+// currentState returns the state at a break, or the last one
+func (d *Debugger) currentState() *lua.LState {
+	d.mutexRun.Lock()
+	defer d.mutexRun.Unlock()
+	return d.CurrentState
+}
+
+// isBreakingAt reports whether L is blocked at a break
+func (d *Debugger) isBreakingAt(L *lua.LState) bool {
+	d.mutexRun.Lock()
+	defer d.mutexRun.Unlock()
+	return d.blocking && d.CurrentState == L
+}
 
-			variable := d.GetVariable(name, value, 1)
-			stack.LocalVariables = append(stack.LocalVariables, variable)
+func (d *Debugger) newStack(L *lua.LState, ar *lua.Debug, level int) *Stack {
+	return &Stack{
+		File:         d.GetFile(L, &Ar{Debug: *ar}),
+		FunctionName: ar.Name,
+		Level:        level,
+		Line:         ar.CurrentLine,
+	}
+}
+
+// getVariables fills the locals and upvalues of the frame ar into stack,
+// the tables are expanded to depth
+func (d *Debugger) getVariables(L *lua.LState, ar *lua.Debug, stack *Stack, depth int) {
+	for i := 1; ; i++ {
+		name, value := L.GetLocal(ar, i)
+		if name == "" {
+			break
+		}
+		if name[0] == '(' {
+			continue
 		}
 
-		if f, _ := L.GetInfo("f", ar, nil); f != lua.LNil {
-			for i := 1; ; i++ {
-				name, value := L.GetUpvalue(f.(*lua.LFunction), i)
-				if name == "" {
-					break
-				}
+		variable := d.GetVariable(name, value, depth)
+		stack.LocalVariables = append(stack.LocalVariables, variable)
+	}
 
-				variable := d.GetVariable(name, value, 1)
-				stack.UpvalueVariables = append(stack.UpvalueVariables, variable)
+	if f, _ := L.GetInfo("f", ar, nil); f != lua.LNil {
+		for i := 1; ; i++ {
+			name, value := L.GetUpvalue(f.(*lua.LFunction), i)
+			if name == "" {
+				break
 			}
+
+			variable := d.GetVariable(name, value, depth)
+			stack.UpvalueVariables = append(stack.UpvalueVariables, variable)
 		}
-		level++
 	}
-	return stacks
 }
 
 func (d *Debugger) HandleBreak(L *lua.LState) {
-	d.CurrentState = L
+	d.mutexBreak.Lock()
+	defer d.mutexBreak.Unlock()
+
 	d.UpdateHook(L, "l") // TODO
+	// must be blocking before the IDE knows the break, or the following
+	// eval and action may be lost
+	d.mutexRun.Lock()
+	d.CurrentState = L
+	d.blocking = true
+	d.mutexRun.Unlock()
 	d.fcd.OnBreak(L)
 	d.EnterDebugMode(L)
 }
@@ -284,7 +533,6 @@ func (d *Debugger) EnterDebugMode(L *lua.LState) {
 	d.mutexRun.Lock()
 	defer d.mutexRun.Unlock()
 
-	d.blocking = true
 	for {
 		d.mutexEval.Lock()
 		if d.evalQueue.Len() == 0 && d.blocking {
@@ -294,17 +542,22 @@ func (d *Debugger) EnterDebugMode(L *lua.LState) {
 		}
 
 		if d.evalQueue.Len() > 0 {
-			evalContextNode := d.evalQueue.Front()
-			d.evalQueue.Remove(evalContextNode)
+			node := d.evalQueue.Front()
+			d.evalQueue.Remove(node)
 			d.mutexEval.Unlock()
 
-			skip := d.SkipHook
-			d.SkipHook = true
-
-			evalContext, _ := evalContextNode.Value.(*EvalContext)
-			evalContext.Success = d.DoEval(evalContext)
-			d.SkipHook = skip
-			d.fcd.OnEvalResult(evalContext)
+			switch task := node.Value.(type) {
+			case *EvalContext:
+				d.withoutHook(L, func() {
+					task.Success = d.DoEval(task)
+				})
+				d.evalDone(task)
+			case *breakTask:
+				d.withoutHook(L, func() {
+					task.fn(L)
+				})
+				close(task.done)
+			}
 			continue
 		}
 		d.mutexEval.Unlock()
@@ -313,19 +566,83 @@ func (d *Debugger) EnterDebugMode(L *lua.LState) {
 }
 
 func (d *Debugger) ExitDebugMode() {
+	d.mutexRun.Lock()
 	d.blocking = false
+	d.mutexRun.Unlock()
 	d.condRun.Broadcast()
 }
 
-func (d *Debugger) Eval(ctx *EvalContext) {
-	if !d.blocking {
+// rejectEvals answers the queued evals and tasks with the error reason
+func (d *Debugger) rejectEvals(reason string) {
+	var rejected []interface{}
+	d.mutexEval.Lock()
+	for e := d.evalQueue.Front(); e != nil; e = e.Next() {
+		rejected = append(rejected, e.Value)
+	}
+	d.evalQueue.Init()
+	d.mutexEval.Unlock()
+
+	for _, task := range rejected {
+		switch task := task.(type) {
+		case *EvalContext:
+			task.Success = false
+			task.Error = reason
+			d.evalDone(task)
+		case *breakTask:
+			task.err = errors.New(reason)
+			close(task.done)
+		}
+	}
+}
+
+func (d *Debugger) evalDone(ctx *EvalContext) {
+	if ctx.done != nil {
+		ctx.done(ctx)
 		return
 	}
+	d.fcd.OnEvalResult(ctx)
+}
+
+// Eval queues ctx for the state blocked at a break, it fails if there's none
+func (d *Debugger) Eval(ctx *EvalContext) error {
+	d.mutexRun.Lock()
+	defer d.mutexRun.Unlock()
+	if !d.blocking {
+		return errors.New("not at a break")
+	}
 
 	d.mutexEval.Lock()
 	d.evalQueue.PushBack(ctx)
 	d.mutexEval.Unlock()
 	d.condRun.Broadcast()
+	return nil
+}
+
+// breakTask is a function queued with the evals, it runs on the goroutine of
+// the state blocked at a break, which is the only one allowed to use it
+type breakTask struct {
+	fn   func(L *lua.LState)
+	err  error
+	done chan struct{}
+}
+
+// runAtBreak runs fn with the state blocked at a break on its goroutine, and
+// waits for it. It fails if there's no such state
+func (d *Debugger) runAtBreak(fn func(L *lua.LState)) error {
+	task := &breakTask{fn: fn, done: make(chan struct{})}
+	d.mutexRun.Lock()
+	if !d.blocking {
+		d.mutexRun.Unlock()
+		return errors.New("not at a break")
+	}
+	d.mutexEval.Lock()
+	d.evalQueue.PushBack(task)
+	d.mutexEval.Unlock()
+	d.mutexRun.Unlock()
+	d.condRun.Broadcast()
+
+	<-task.done
+	return task.err
 }
 
 func (d *Debugger) DoEval(evalContext *EvalContext) bool {
@@ -333,21 +650,21 @@ func (d *Debugger) DoEval(evalContext *EvalContext) bool {
 	statement := "return " + evalContext.Expr
 	f, err := L.LoadString(statement)
 	if err != nil {
-		log.Println("Debugger:DoEval loadstring fail:", err)
+		d.logln(proto.LogWarning, "Debugger:DoEval loadstring fail:", err)
 		evalContext.Error = err.Error()
 		return false
 	}
 
 	env, ok := d.CreateEnv(evalContext.StackLevel)
 	if !ok {
-		log.Println("Debugger:DoEval create env fail")
+		d.logln(proto.LogWarning, "Debugger:DoEval create env fail")
 		return false
 	}
 	L.SetFEnv(f, env)
 
 	L.Push(f)
 	if err := L.PCall(0, 1, nil); err != nil {
-		log.Println("Debugger:DoEval call fail", err)
+		d.logln(proto.LogWarning, "Debugger:DoEval call fail", err)
 		evalContext.Error = err.Error()
 		return false
 	}
@@ -383,14 +700,48 @@ func EnvIndexFunction(L *lua.LState) int {
 	return 0
 }
 
+// checkCondition reports whether the condition of bp is true in the frame of
+// the hooked line, a bad condition breaks so the user can see it
+func (d *Debugger) checkCondition(L *lua.LState, bp *BreakPoint) bool {
+	if bp.Condition == "" {
+		return true
+	}
+	f, err := L.LoadString("return " + bp.Condition)
+	if err != nil {
+		d.logln(proto.LogWarning, "Debugger:checkCondition loadstring fail:", err)
+		return true
+	}
+	// level 0 is the hook
+	env, ok := d.createEnv(L, 1)
+	if !ok {
+		return true
+	}
+	L.SetFEnv(f, env)
+
+	L.Push(f)
+	d.withoutHook(L, func() {
+		err = L.PCall(0, 1, nil)
+	})
+	if err != nil {
+		d.logln(proto.LogWarning, "Debugger:checkCondition call fail:", err)
+		return true
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	return lua.LVAsBool(result)
+}
+
 func (d *Debugger) CreateEnv(stackLevel int) (*lua.LTable, bool) {
-	L := d.CurrentState
+	return d.createEnv(d.CurrentState, stackLevel)
+}
+
+func (d *Debugger) createEnv(L *lua.LState, stackLevel int) (*lua.LTable, bool) {
 	ar, ok := L.GetStack(stackLevel)
 	if !ok {
 		return nil, false
 	}
 	if _, err := L.GetInfo("nSlu", ar, nil); err != nil {
-		log.Println(err)
+		d.logln(proto.LogError, "Debugger:createEnv get info fail:", err)
 		return nil, false
 	}
 
@@ -501,11 +852,13 @@ func (d *Debugger) MatchFileName(chunkName string, fileName string) bool {
 
 func (d *Debugger) FindBreakPoint(L *lua.LState, ar *Ar) *BreakPoint {
 	if ar.CurrentLine >= 0 {
+		d.mutexBP.Lock()
 		_, lineExist := d.LineSet[ar.CurrentLine]
+		d.mutexBP.Unlock()
 		if lineExist {
 			_, err := L.GetInfo("S", &ar.Debug, nil)
 			if err != nil {
-				log.Println("find break point fail:", err)
+				d.logln(proto.LogError, "find break point fail:", err)
 				return nil
 			}
 
@@ -549,25 +902,61 @@ func (d *Debugger) FindBreakPointByFile(file string, line int) *BreakPoint {
 	return nil
 }
 
-func (d *Debugger) RemoveBreakPoint(file string, line int) {
+// RemoveBreakPoint removes a breakpoint at line of file, it returns false if
+// there's none
+func (d *Debugger) RemoveBreakPoint(file string, line int) bool {
 	lowerCaseFile := strings.ToLower(file)
 	d.mutexBP.Lock()
 	defer d.mutexBP.Unlock()
 
+	removed := false
 	for i, bp := range d.BreakPoints {
 		if bp.File == lowerCaseFile && bp.Line == line {
 			d.BreakPoints = append(d.BreakPoints[:i], d.BreakPoints[i+1:]...)
+			removed = true
 			break
 		}
 	}
 	d.RefreshLineSet()
+	return removed
+}
+
+// GetBreakPoints returns a copy of the breakpoints
+func (d *Debugger) GetBreakPoints() []BreakPoint {
+	d.mutexBP.Lock()
+	defer d.mutexBP.Unlock()
+
+	bps := make([]BreakPoint, 0, len(d.BreakPoints))
+	for _, bp := range d.BreakPoints {
+		bps = append(bps, *bp)
+	}
+	return bps
 }
 
 func (d *Debugger) RemoveAllBreakpoints() {
+	d.mutexBP.Lock()
+	defer d.mutexBP.Unlock()
+
 	d.LineSet = make(map[int]struct{})
 	d.BreakPoints = []*BreakPoint{}
 }
 
+// checkBreakPoint checks bp before it's added, the condition must compile
+func checkBreakPoint(bp *BreakPoint) error {
+	if bp.File == "" {
+		return errors.New("breakpoint without file")
+	}
+	if bp.Line <= 0 {
+		return fmt.Errorf("invalid line %d of %s", bp.Line, bp.File)
+	}
+	if bp.Condition != "" {
+		if _, err := parse.Parse(strings.NewReader("return "+bp.Condition), "condition"); err != nil {
+			return fmt.Errorf("invalid condition of %s:%d: %v", bp.File, bp.Line, err)
+		}
+	}
+	return nil
+}
+
 func (d *Debugger) AddBreakPoint(bp *BreakPoint) {
 	d.mutexBP.Lock()
 	defer d.mutexBP.Unlock()
@@ -579,10 +968,11 @@ func (d *Debugger) AddBreakPoint(bp *BreakPoint) {
 	d.RefreshLineSet()
 }
 
+// RefreshLineSet rebuilds LineSet from the breakpoints, mutexBP must be held
 func (d *Debugger) RefreshLineSet() {
-	d.LineSet = make(map[int]struct{})
-
+	lineSet := make(map[int]struct{}, len(d.BreakPoints))
 	for _, bp := range d.BreakPoints {
-		d.LineSet[bp.Line] = struct{}{}
+		lineSet[bp.Line] = struct{}{}
 	}
+	d.LineSet = lineSet
 }
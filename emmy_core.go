@@ -3,6 +3,10 @@ package lua_debugger
 import (
 	lua "github.com/yuin/gopher-lua"
 	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 )
 
 func init() {
@@ -13,16 +17,51 @@ const (
 	KeyDebuggerFcd = "__Debugger_Fcd"
 )
 
-func TcpConnect(L *lua.LState) int {
-	host := L.CheckString(1)
-	port := L.CheckNumber(2)
+var (
+	sharedMutex   sync.Mutex
+	sharedFacades = map[string]*Facade{}
+)
 
+func registerFacade(L *lua.LState) *Facade {
 	fcd := newFacade()
+	setFacade(L, fcd)
+	return fcd
+}
+
+func setFacade(L *lua.LState, fcd *Facade) {
 	fcdUd := L.NewUserData()
 	fcdUd.Value = fcd
 	L.SetField(L.Get(lua.RegistryIndex), KeyDebuggerFcd, fcdUd)
+}
+
+func getFacade(L *lua.LState) *Facade {
+	if fcdUd, ok := L.GetField(L.Get(lua.RegistryIndex), KeyDebuggerFcd).(*lua.LUserData); ok {
+		if fcd, ok := fcdUd.Value.(*Facade); ok {
+			return fcd
+		}
+	}
+	return nil
+}
+
+func unregisterFacade(L *lua.LState) {
+	L.SetField(L.Get(lua.RegistryIndex), KeyDebuggerFcd, lua.LNil)
+}
+
+// Connect starts debugging L through t from go code. Like tcpConnect, it
+// blocks until the IDE is ready and must be called while L is running lua
+// code, e.g. from a go function called by lua. opts may be nil
+func Connect(L *lua.LState, t Transport, opts *Options) error {
+	fcd := registerFacade(L)
+	if err := fcd.Connect(L, t, opts); err != nil {
+		unregisterFacade(L)
+		return err
+	}
+	return nil
+}
 
-	if err := fcd.TcpConnect(L, host, int(port)); err != nil {
+func pushStartResult(L *lua.LState, err error) int {
+	if err != nil {
+		unregisterFacade(L)
 		L.Push(lua.LFalse)
 		L.Push(lua.LString(err.Error()))
 		return 2
@@ -31,8 +70,191 @@ func TcpConnect(L *lua.LState) int {
 	return 1
 }
 
+func TcpConnect(L *lua.LState) int {
+	host := L.CheckString(1)
+	port := L.CheckNumber(2)
+	opts := checkOptions(L, 3)
+
+	fcd := registerFacade(L)
+	return pushStartResult(L, fcd.TcpConnect(L, host, int(port), opts))
+}
+
+func TcpListen(L *lua.LState) int {
+	host := L.CheckString(1)
+	port := L.CheckNumber(2)
+	opts := checkOptions(L, 3)
+
+	fcd := registerFacade(L)
+	return pushStartResult(L, fcd.TcpListen(L, host, int(port), opts))
+}
+
+func PipeConnect(L *lua.LState) int {
+	path := L.CheckString(1)
+	opts := checkOptions(L, 2)
+
+	fcd := registerFacade(L)
+	return pushStartResult(L, fcd.PipeConnect(L, path, opts))
+}
+
+func PipeListen(L *lua.LState) int {
+	path := L.CheckString(1)
+	opts := checkOptions(L, 2)
+
+	fcd := registerFacade(L)
+	return pushStartResult(L, fcd.PipeListen(L, path, opts))
+}
+
+func WsConnect(L *lua.LState) int {
+	url := L.CheckString(1)
+	opts := checkOptions(L, 2)
+
+	fcd := registerFacade(L)
+	return pushStartResult(L, fcd.WsConnect(L, url, opts))
+}
+
+func WsListen(L *lua.LState) int {
+	host := L.CheckString(1)
+	port := L.CheckNumber(2)
+	opts := checkOptions(L, 3)
+
+	fcd := registerFacade(L)
+	return pushStartResult(L, fcd.WsListen(L, host, int(port), opts))
+}
+
+// DapListen waits for a DAP client instead of the EmmyLua IDE
+func DapListen(L *lua.LState) int {
+	host := L.CheckString(1)
+	port := L.CheckNumber(2)
+	opts := checkOptions(L, 3)
+
+	fcd := registerFacade(L)
+	return pushStartResult(L, fcd.DapListen(L, host, int(port), opts))
+}
+
+// MobdebugConnect connects to ZeroBrane Studio instead of the EmmyLua IDE,
+// the host and port default to localhost:8172 like mobdebug.start()
+func MobdebugConnect(L *lua.LState) int {
+	host := L.OptString(1, "localhost")
+	port := L.OptInt(2, MobdebugDefaultPort)
+	opts := checkOptions(L, 3)
+
+	fcd := registerFacade(L)
+	return pushStartResult(L, fcd.MobdebugConnect(L, host, port, opts))
+}
+
+// TcpSharedListen lets all the states calling it with the same address share
+// one listener and one debugger, the IDE sees them through one connection.
+// It doesn't wait for the IDE, use waitIDE if needed. The listener is closed
+// when the last state stops
+func TcpSharedListen(L *lua.LState) int {
+	host := L.CheckString(1)
+	port := L.CheckNumber(2)
+	opts := checkOptions(L, 3)
+
+	return pushStartResult(L, joinSharedFacade(L, host, int(port), opts))
+}
+
+// sharedFacade returns the facade listening on host:port, it's created at
+// the first time
+func sharedFacade(host string, port int, opts *Options) (*Facade, error) {
+	sharedMutex.Lock()
+	defer sharedMutex.Unlock()
+	return sharedFacadeLocked(host, port, opts)
+}
+
+// joinSharedFacade adds L to the facade listening on host:port, so the last
+// state leaving can't close it in between. It must be called on the
+// goroutine running L
+func joinSharedFacade(L *lua.LState, host string, port int, opts *Options) error {
+	sharedMutex.Lock()
+	defer sharedMutex.Unlock()
+
+	fcd, err := sharedFacadeLocked(host, port, opts)
+	if err != nil {
+		return err
+	}
+	setFacade(L, fcd)
+	fcd.AddState(L)
+	return nil
+}
+
+func sharedFacadeLocked(host string, port int, opts *Options) (*Facade, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	fcd := sharedFacades[addr]
+	if fcd == nil {
+		fcd = newFacade()
+		if err := fcd.ListenShared(host, port, opts); err != nil {
+			return nil, err
+		}
+		sharedFacades[addr] = fcd
+	}
+	return fcd, nil
+}
+
+// unshareFacade forgets the closed shared facade, the next state listening
+// on its address starts a new one
+func unshareFacade(fcd *Facade) {
+	sharedMutex.Lock()
+	defer sharedMutex.Unlock()
+	unshareFacadeLocked(fcd)
+}
+
+func unshareFacadeLocked(fcd *Facade) {
+	for addr, shared := range sharedFacades {
+		if shared == fcd {
+			delete(sharedFacades, addr)
+		}
+	}
+}
+
+// WaitIDE blocks until the IDE is ready or the optional timeout in
+// milliseconds, it returns immediately if the IDE is already ready
+func WaitIDE(L *lua.LState) int {
+	timeout := time.Duration(L.OptInt(1, 0)) * time.Millisecond
+	fcd := getFacade(L)
+	if fcd == nil {
+		return LuaError(L, "not connected, call one of the connect or listen functions first")
+	}
+	if err := fcd.waitIDEReady(L, timeout); err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// BreakHere breaks at the current line, it returns false if no IDE is ready
+func BreakHere(L *lua.LState) int {
+	fcd := getFacade(L)
+	if fcd == nil || !fcd.BreakHere(L) {
+		L.Push(lua.LFalse)
+		return 1
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// Stop detaches the debugger and closes the connection to the IDE, a state
+// sharing the connection only detaches itself
+func Stop(L *lua.LState) int {
+	Detach(L)
+	return 0
+}
+
 var coreApi = map[string]lua.LGFunction{
-	"tcpConnect": TcpConnect,
+	"tcpConnect":      TcpConnect,
+	"tcpListen":       TcpListen,
+	"pipeConnect":     PipeConnect,
+	"pipeListen":      PipeListen,
+	"wsConnect":       WsConnect,
+	"wsListen":        WsListen,
+	"tcpSharedListen": TcpSharedListen,
+	"dapListen":       DapListen,
+	"mobdebugConnect": MobdebugConnect,
+	"waitIDE":         WaitIDE,
+	"breakHere":       BreakHere,
+	"stop":            Stop,
 }
 
 func Loader(L *lua.LState) int {
@@ -42,6 +264,11 @@ func Loader(L *lua.LState) int {
 	return 1
 }
 
+// Preload preloads the emmy_core module. If GLUA_DEBUG is set, L is attached
+// too if it's the first state or the mode is shared, see AttachFromEnv
 func Preload(L *lua.LState) {
 	L.PreloadModule("emmy_core", Loader)
+	if err := AttachFromEnv(L); err != nil {
+		log.Println("attach from env fail:", err)
+	}
 }
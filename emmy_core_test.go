@@ -0,0 +1,197 @@
+package lua_debugger
+
+import (
+	"fmt"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	lua "github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBreakHere_NotConnected(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	Preload(L)
+
+	err := L.DoString(`
+		local dbg = require('emmy_core')
+		assert(dbg.breakHere() == false)
+		dbg.stop()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBreakHere_NonBlocking(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+
+	L := lua.NewState()
+	defer L.Close()
+	Preload(L)
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := Connect(L, dbgSide, &Options{NonBlocking: true}); err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+	done := make(chan error, 1)
+	go func() {
+		done <- L.DoString(`connect()
+			local dbg = require('emmy_core')
+			while not dbg.breakHere() do end`)
+	}()
+
+	// the loop checks the IDE while it becomes ready
+	ide.start(nil)
+	ide.expectStarted()
+	ide.expectBreak()
+	ide.action(proto.Continue)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lua not continued")
+	}
+}
+
+func TestTcpConnect_NoIDE(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	Preload(L)
+
+	err = L.DoString(fmt.Sprintf(`
+		local dbg = require('emmy_core')
+		local ok, err = dbg.tcpConnect('127.0.0.1', %d, { dialTimeout = 100, retries = 1, retryInterval = 10 })
+		assert(ok == false and err ~= nil)
+		assert(dbg.breakHere() == false)
+	`, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTcpConnect_WaitTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// accept and never say ready
+		c, err := l.Accept()
+		if err == nil {
+			defer c.Close()
+			_, _ = io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	L := lua.NewState()
+	defer L.Close()
+	Preload(L)
+
+	err = L.DoString(fmt.Sprintf(`
+		local dbg = require('emmy_core')
+		local ok, err = dbg.tcpConnect('127.0.0.1', %d, { waitTimeout = 100 })
+		assert(ok == false and err ~= nil)
+	`, l.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTcpSharedListen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	const script = `local dbg = require('emmy_core')
+		assert(dbg.tcpSharedListen('127.0.0.1', %d))
+		started()
+		while not stopped() do
+			local x = 1
+		end
+		dbg.stop()`
+
+	started := make(chan struct{}, 2)
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		L := lua.NewState()
+		defer L.Close()
+		Preload(L)
+		stopped := false
+		L.SetGlobal("started", L.NewFunction(func(L *lua.LState) int {
+			started <- struct{}{}
+			return 0
+		}))
+		L.SetGlobal("stopLoop", L.NewFunction(func(L *lua.LState) int {
+			stopped = true
+			return 0
+		}))
+		L.SetGlobal("stopped", L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LBool(stopped))
+			return 1
+		}))
+		go func() {
+			done <- L.DoString(fmt.Sprintf(script, port))
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("state not started")
+		}
+	}
+
+	trans := &NetTransport{}
+	ide := newTestIDE(t, trans)
+	if err := trans.Connect("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	ide.start(nil, proto.BreakPoint{File: "<string>", Line: 5})
+	ide.expectStarted()
+
+	// every state breaks once through the same connection
+	for i := 0; i < 2; i++ {
+		ide.expectBreak()
+		ide.Send(proto.MsgIdEvalReq, proto.EvalReq{Seq: i, Expr: "stopLoop()", StackLevel: 1})
+		if rsp := ide.expect(&proto.EvalRsp{}).(*proto.EvalRsp); !rsp.Success {
+			t.Fatal("eval fail", rsp.Error)
+		}
+		ide.action(proto.Continue)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("state not done")
+		}
+	}
+
+	// the listener is closed with the last state
+	l, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal("listener not closed:", err)
+	}
+	_ = l.Close()
+}
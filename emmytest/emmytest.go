@@ -0,0 +1,362 @@
+// Package emmytest plays the EmmyLua IDE in tests. It drives a debugged lua
+// state like the IDE does, so the debugging behaviour of scripts can be
+// tested without an IDE:
+//
+//	ide := emmytest.Listen(t, "127.0.0.1:0")
+//	defer ide.Close()
+//	go L.DoString(fmt.Sprintf(`require("emmy_core").tcpConnect("127.0.0.1", %d)
+//	...`, ide.Port()))
+//	ide.Start(emmytest.BreakPoint("main.lua", 10))
+//	ide.ExpectStopAt("main.lua", 10)
+//	ide.Step()
+//	ide.ExpectStopAt("main.lua", 11)
+package emmytest
+
+import (
+	lua_debugger "github.com/edolphin-ydf/gopherlua-debugger"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultTimeout is the time an Expect waits for the debugger
+const DefaultTimeout = 5 * time.Second
+
+// disconnected is queued when the transport loses the debugger
+type disconnected struct{}
+
+// IDE is the IDE side of a debug session, the methods must be called on the
+// test goroutine
+type IDE struct {
+	// Timeout limits the waits of the Expect methods, DefaultTimeout if 0
+	Timeout time.Duration
+	// Secret is sent in AuthReq by Start if it's set
+	Secret string
+	// Capabilities are sent in InitReq by Start
+	Capabilities []string
+
+	tb        testing.TB
+	t         lua_debugger.Transport
+	l         net.Listener
+	connected chan struct{}
+
+	msgs    chan interface{}
+	backlog []interface{}
+	last    *proto.BreakNotify
+	evalSeq int
+	once    sync.Once
+}
+
+// New makes an IDE talking through t, e.g. the IDE end of
+// lua_debugger.NewMemTransportPair
+func New(tb testing.TB, t lua_debugger.Transport) *IDE {
+	ide := newIDE(tb, t)
+	close(ide.connected)
+	return ide
+}
+
+// Listen makes an IDE waiting on addr for a state calling tcpConnect, use
+// "127.0.0.1:0" for a free port and Port to get it
+func Listen(tb testing.TB, addr string) *IDE {
+	tb.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		tb.Fatal("emmytest: listen fail:", err)
+	}
+
+	t := &lua_debugger.NetTransport{}
+	ide := newIDE(tb, t)
+	ide.l = l
+	go func() {
+		c, err := l.Accept()
+		_ = l.Close()
+		if err != nil {
+			return
+		}
+		t.ServeConn(c)
+		close(ide.connected)
+	}()
+	return ide
+}
+
+func newIDE(tb testing.TB, t lua_debugger.Transport) *IDE {
+	ide := &IDE{
+		tb:        tb,
+		t:         t,
+		connected: make(chan struct{}),
+		msgs:      make(chan interface{}, 256),
+	}
+	t.SetHandler(ide.handleMsg)
+	return ide
+}
+
+func (ide *IDE) handleMsg(cmd int, msg interface{}) {
+	if req, ok := msg.(*proto.ActionReq); ok && req.Action == proto.Stop {
+		ide.msgs <- disconnected{}
+		return
+	}
+	if cmd >= 0 {
+		ide.msgs <- msg
+	}
+}
+
+// Addr returns the address the IDE listens on
+func (ide *IDE) Addr() net.Addr {
+	if ide.l == nil {
+		return nil
+	}
+	return ide.l.Addr()
+}
+
+// Port returns the port the IDE listens on
+func (ide *IDE) Port() int {
+	if addr, ok := ide.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+func (ide *IDE) timeout() time.Duration {
+	if ide.Timeout > 0 {
+		return ide.Timeout
+	}
+	return DefaultTimeout
+}
+
+// BreakPoint makes a breakpoint for Start and AddBreakPoint
+func BreakPoint(file string, line int) proto.BreakPoint {
+	return proto.BreakPoint{File: file, Line: line}
+}
+
+// Start waits for the debugger to connect, then sets the breakpoints and
+// tells it the IDE is ready
+func (ide *IDE) Start(bps ...proto.BreakPoint) {
+	ide.tb.Helper()
+	select {
+	case <-ide.connected:
+	case <-time.After(ide.timeout()):
+		ide.tb.Fatal("emmytest: debugger not connected")
+	}
+
+	if ide.Secret != "" {
+		ide.t.Send(proto.MsgIdAuthReq, &proto.AuthReq{Secret: ide.Secret})
+		rsp := ide.expect("AuthRsp", func(msg interface{}) bool {
+			_, ok := msg.(*proto.AuthRsp)
+			return ok
+		}).(*proto.AuthRsp)
+		if !rsp.Success {
+			ide.tb.Fatal("emmytest: auth fail:", rsp.Error)
+		}
+	}
+	ide.t.Send(proto.MsgIdInitReq, &proto.InitReq{
+		Ext:          []string{".lua"},
+		Version:      proto.Version,
+		Capabilities: ide.Capabilities,
+	})
+	if len(bps) > 0 {
+		ide.t.Send(proto.MsgIdAddBreakPointReq, &proto.AddBreakPointReq{BreakPoints: bps})
+	}
+	ide.t.Send(proto.MsgIdReadyReq, &proto.ReadyReq{})
+}
+
+// AddBreakPoint adds a breakpoint, the condition is optional
+func (ide *IDE) AddBreakPoint(file string, line int, condition string) {
+	bp := proto.BreakPoint{File: file, Line: line, Condition: condition}
+	ide.t.Send(proto.MsgIdAddBreakPointReq, &proto.AddBreakPointReq{BreakPoints: []proto.BreakPoint{bp}})
+}
+
+func (ide *IDE) RemoveBreakPoint(file string, line int) {
+	bp := proto.BreakPoint{File: file, Line: line}
+	ide.t.Send(proto.MsgIdRemoveBreakPointReq, &proto.RemoveBreakPointReq{BreakPoints: []proto.BreakPoint{bp}})
+}
+
+// expect returns the first message matching match, the BreakNotify, EvalRsp
+// and output skipped are kept for the later calls, the others are dropped
+func (ide *IDE) expect(what string, match func(msg interface{}) bool) interface{} {
+	ide.tb.Helper()
+	for i, msg := range ide.backlog {
+		if match(msg) {
+			ide.backlog = append(ide.backlog[:i], ide.backlog[i+1:]...)
+			return msg
+		}
+	}
+
+	timeout := time.After(ide.timeout())
+	for {
+		select {
+		case msg := <-ide.msgs:
+			if match(msg) {
+				return msg
+			}
+			switch m := msg.(type) {
+			case disconnected:
+				ide.tb.Fatalf("emmytest: debugger disconnected while waiting for %s", what)
+			case *proto.ErrorNotify:
+				ide.tb.Logf("emmytest: debugger error: %s", m.Error)
+			case *proto.AddBreakPointRsp:
+				if !m.Success {
+					ide.tb.Logf("emmytest: add breakpoint fail: %s", m.Error)
+				}
+			case *proto.RemoveBreakPointRsp:
+				if !m.Success {
+					ide.tb.Logf("emmytest: remove breakpoint fail: %s", m.Error)
+				}
+			case *proto.ActionRsp:
+				if !m.Success {
+					ide.tb.Logf("emmytest: action fail: %s", m.Error)
+				}
+			case *proto.LogNotify:
+				if m.Output {
+					ide.backlog = append(ide.backlog, msg)
+				} else {
+					ide.tb.Logf("emmytest: debugger log: %s", m.Message)
+				}
+			case *proto.BreakNotify, *proto.EvalRsp:
+				ide.backlog = append(ide.backlog, msg)
+			}
+		case <-timeout:
+			ide.tb.Fatalf("emmytest: %s not received", what)
+		}
+	}
+}
+
+// ExpectStop waits for the next break and returns it
+func (ide *IDE) ExpectStop() *proto.BreakNotify {
+	ide.tb.Helper()
+	notify := ide.expect("BreakNotify", func(msg interface{}) bool {
+		_, ok := msg.(*proto.BreakNotify)
+		return ok
+	}).(*proto.BreakNotify)
+	ide.last = notify
+	return notify
+}
+
+// ExpectStopAt waits for the next break and checks it's at line of a file
+// ending with file
+func (ide *IDE) ExpectStopAt(file string, line int) *proto.BreakNotify {
+	ide.tb.Helper()
+	notify := ide.ExpectStop()
+	top, ok := topFrame(notify)
+	if !ok {
+		ide.tb.Fatal("emmytest: no lua frame in the break")
+	}
+	if !matchFile(top.File, file) || top.Line != line {
+		ide.tb.Fatalf("emmytest: stopped at %s:%d, expect %s:%d", top.File, top.Line, file, line)
+	}
+	return notify
+}
+
+// ExpectOutput waits for the output of print or io.write containing text,
+// the state must capture its output, see Options.CaptureOutput
+func (ide *IDE) ExpectOutput(text string) *proto.LogNotify {
+	ide.tb.Helper()
+	return ide.expect("output "+text, func(msg interface{}) bool {
+		notify, ok := msg.(*proto.LogNotify)
+		return ok && notify.Output && strings.Contains(notify.Message, text)
+	}).(*proto.LogNotify)
+}
+
+// ExpectDisconnected waits until the debugger is gone, e.g. the state is
+// stopped or closed
+func (ide *IDE) ExpectDisconnected() {
+	ide.tb.Helper()
+	ide.expect("disconnection", func(msg interface{}) bool {
+		_, ok := msg.(disconnected)
+		return ok
+	})
+}
+
+func topFrame(notify *proto.BreakNotify) (proto.Stack, bool) {
+	for _, stack := range notify.Stacks {
+		if stack.Line >= 0 {
+			return stack, true
+		}
+	}
+	return proto.Stack{}, false
+}
+
+func matchFile(got, want string) bool {
+	got, want = path.Clean(strings.Replace(got, "\\", "/", -1)), path.Clean(want)
+	return got == want || strings.HasSuffix(got, "/"+want)
+}
+
+func (ide *IDE) action(action proto.DebugAction) {
+	ide.last = nil
+	ide.t.Send(proto.MsgIdActionReq, &proto.ActionReq{Action: action})
+}
+
+func (ide *IDE) Continue() {
+	ide.action(proto.Continue)
+}
+
+// Step steps in, use ExpectStopAt for the line it stops at
+func (ide *IDE) Step() {
+	ide.action(proto.StepIn)
+}
+
+func (ide *IDE) StepOver() {
+	ide.action(proto.StepOver)
+}
+
+func (ide *IDE) StepOut() {
+	ide.action(proto.StepOut)
+}
+
+// Pause breaks the running state at the next line
+func (ide *IDE) Pause() {
+	ide.action(proto.Break)
+}
+
+// Stop stops debugging, the state goes on without the debugger
+func (ide *IDE) Stop() {
+	ide.action(proto.Stop)
+}
+
+// Eval evaluates expr in the top lua frame of the last break
+func (ide *IDE) Eval(expr string) *proto.EvalRsp {
+	ide.tb.Helper()
+	if ide.last == nil {
+		ide.tb.Fatal("emmytest: eval without a break")
+	}
+	top, _ := topFrame(ide.last)
+	return ide.EvalAt(expr, top.Level)
+}
+
+// EvalAt evaluates expr in the frame at level, the tables are expanded one
+// level
+func (ide *IDE) EvalAt(expr string, level int) *proto.EvalRsp {
+	ide.tb.Helper()
+	ide.evalSeq++
+	seq := ide.evalSeq
+	ide.t.Send(proto.MsgIdEvalReq, &proto.EvalReq{Seq: seq, Expr: expr, StackLevel: level, Depth: 1})
+	return ide.expect("EvalRsp", func(msg interface{}) bool {
+		rsp, ok := msg.(*proto.EvalRsp)
+		return ok && rsp.Seq == seq
+	}).(*proto.EvalRsp)
+}
+
+// ExpectValue evaluates expr like Eval and checks its value
+func (ide *IDE) ExpectValue(expr string, value string) {
+	ide.tb.Helper()
+	rsp := ide.Eval(expr)
+	if !rsp.Success {
+		ide.tb.Fatalf("emmytest: eval %s fail: %s", expr, rsp.Error)
+	}
+	if rsp.Value.Value != value {
+		ide.tb.Fatalf("emmytest: %s is %s, expect %s", expr, rsp.Value.Value, value)
+	}
+}
+
+// Close disconnects from the debugger
+func (ide *IDE) Close() {
+	ide.once.Do(func() {
+		if ide.l != nil {
+			_ = ide.l.Close()
+		}
+		_ = ide.t.Close()
+	})
+}
@@ -0,0 +1,90 @@
+package emmytest
+
+import (
+	"fmt"
+	lua_debugger "github.com/edolphin-ydf/gopherlua-debugger"
+	lua "github.com/yuin/gopher-lua"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testScript = `local function add(a, b)
+	return a + b
+end
+local x = add(1, 2)
+result = x
+`
+
+func runScript(L *lua.LState, script string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		fn, err := L.Load(strings.NewReader(script), "test.lua")
+		if err == nil {
+			L.Push(fn)
+			err = L.PCall(0, 0, nil)
+		}
+		done <- err
+	}()
+	return done
+}
+
+func expectDone(t *testing.T, done <-chan error) {
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(DefaultTimeout):
+		t.Fatal("script not done")
+	}
+}
+
+func TestIDE_Listen(t *testing.T) {
+	ide := Listen(t, "127.0.0.1:0")
+	defer ide.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	lua_debugger.Preload(L)
+	script := fmt.Sprintf("require('emmy_core').tcpConnect('127.0.0.1', %d)\n", ide.Port()) + testScript
+	done := runScript(L, script)
+
+	ide.Start(BreakPoint("test.lua", 5))
+	ide.ExpectStopAt("test.lua", 5)
+	ide.ExpectValue("add(2, 3)", "5")
+	ide.Step()
+	ide.ExpectStopAt("test.lua", 3)
+	ide.ExpectValue("a", "1")
+	ide.StepOut()
+	ide.ExpectStopAt("test.lua", 6)
+	ide.ExpectValue("x", "3")
+	ide.Continue()
+	expectDone(t, done)
+}
+
+func TestIDE_Mem(t *testing.T) {
+	dbgSide, ideSide := lua_debugger.NewMemTransportPair()
+	ide := New(t, ideSide)
+	ide.Secret = "s3cret"
+	defer ide.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := lua_debugger.Connect(L, dbgSide, &lua_debugger.Options{Secret: "s3cret"}); err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+	done := runScript(L, "connect()\n"+testScript)
+
+	ide.Start()
+	ide.AddBreakPoint("test.lua", 3, "a == 2")
+	ide.AddBreakPoint("test.lua", 6, "")
+	ide.ExpectStopAt("test.lua", 6)
+	ide.ExpectValue("result", "nil")
+	ide.Stop()
+	ide.ExpectDisconnected()
+	expectDone(t, done)
+}
@@ -2,9 +2,17 @@ package lua_debugger
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"github.com/edolphin-ydf/gopherlua-debugger/proto"
 	lua "github.com/yuin/gopher-lua"
+	"log"
+	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,22 +25,52 @@ func LuaError(L *lua.LState, msg string) int {
 	return 0
 }
 
+// capabilities are the protocol features supported by the debugger
+var capabilities = []string{
+	proto.CapLineBreakpoint,
+	proto.CapConditionBreakpoint,
+	proto.CapEval,
+	proto.CapAuth,
+	proto.CapErrorNotify,
+	proto.CapCompress,
+	proto.CapLazyVariables,
+}
+
 type Facade struct {
-	dbg             *Debugger
-	t               *Transport
-	m               sync.Mutex
-	cond            *sync.Cond
-	isWaitingForIDE bool
-	isIDEReady      bool
-	helperCode      string
+	dbg           *Debugger
+	t             Transport
+	m             sync.Mutex
+	cond          *sync.Cond
+	isIDEReady    bool
+	helperCode    string
+	lazyAttach    bool
+	secret        string
+	authenticated bool
+	shared        bool
+	pauseOnEntry  bool
+	closed        int32
+	ideVersion    string
+	ideCaps       map[string]struct{}
+	compressor    *Compressor
+
+	mutexObservers   sync.Mutex
+	observers        map[*observer]struct{}
+	observerListener net.Listener
+	control          *controlServer
 
-	states map[*lua.LState]struct{}
+	mutexStates sync.Mutex
+	states      map[*lua.LState]struct{}
+	// print and io.write of the states are sent to the IDE
+	capture bool
+	outputs map[*lua.LState]*capturedOutput
 }
 
 func newFacade() *Facade {
 	res := &Facade{
-		dbg:    newDebugger(),
-		states: make(map[*lua.LState]struct{}),
+		dbg:       newDebugger(),
+		states:    make(map[*lua.LState]struct{}),
+		outputs:   make(map[*lua.LState]*capturedOutput),
+		observers: make(map[*observer]struct{}),
 	}
 	res.cond = sync.NewCond(&res.m)
 	res.dbg.fcd = res
@@ -40,19 +78,164 @@ func newFacade() *Facade {
 	return res
 }
 
-func (f *Facade) TcpConnect(L *lua.LState, host string, port int) error {
-	f.states[L] = struct{}{}
-	f.t = &Transport{}
-	f.t.Handler = f.HandleMsg
-	if err := f.t.Connect(host, port); err != nil {
-		LuaError(L, err.Error())
+func (f *Facade) TcpConnect(L *lua.LState, host string, port int, opts *Options) error {
+	t := opts.newNetTransport()
+	return f.start(L, t, opts, func() error {
+		return t.Connect(host, port)
+	})
+}
+
+// TcpListen waits for the IDE to connect to host:port, then runs the same
+// handshake as TcpConnect
+func (f *Facade) TcpListen(L *lua.LState, host string, port int, opts *Options) error {
+	t := opts.newNetTransport()
+	return f.start(L, t, opts, func() error {
+		return t.Listen(host, port)
+	})
+}
+
+func (f *Facade) PipeConnect(L *lua.LState, path string, opts *Options) error {
+	t := opts.newNetTransport()
+	return f.start(L, t, opts, func() error {
+		return t.PipeConnect(path)
+	})
+}
+
+// PipeListen waits for the IDE to connect to the unix domain socket at path,
+// then runs the same handshake as TcpConnect
+func (f *Facade) PipeListen(L *lua.LState, path string, opts *Options) error {
+	t := opts.newNetTransport()
+	return f.start(L, t, opts, func() error {
+		return t.PipeListen(path)
+	})
+}
+
+func (f *Facade) WsConnect(L *lua.LState, url string, opts *Options) error {
+	t := opts.newNetTransport()
+	return f.start(L, t, opts, func() error {
+		return t.WsConnect(url)
+	})
+}
+
+// WsListen waits for a websocket frontend to connect to host:port, then runs
+// the same handshake as TcpConnect
+func (f *Facade) WsListen(L *lua.LState, host string, port int, opts *Options) error {
+	t := opts.newNetTransport()
+	return f.start(L, t, opts, func() error {
+		return t.WsListen(host, port)
+	})
+}
+
+// DapListen waits for a Debug Adapter Protocol client, e.g. VS Code or
+// nvim-dap, on host:port, and returns when the client is configured
+func (f *Facade) DapListen(L *lua.LState, host string, port int, opts *Options) error {
+	if opts != nil && opts.Secret != "" {
+		return errors.New("secret is not supported by DAP")
+	}
+	t := NewDapTransport()
+	return f.start(L, t, opts, func() error {
+		return t.Listen(host, port)
+	})
+}
+
+// MobdebugConnect connects to ZeroBrane Studio on host:port with the MobDebug
+// protocol, and returns when the IDE runs or steps the state
+func (f *Facade) MobdebugConnect(L *lua.LState, host string, port int, opts *Options) error {
+	if opts != nil && opts.Secret != "" {
+		return errors.New("secret is not supported by MobDebug")
+	}
+	t := NewMobdebugTransport()
+	return f.start(L, t, opts, func() error {
+		return t.Connect(host, port)
+	})
+}
+
+// Connect talks to the IDE through an already opened transport, e.g. one end
+// of a MemTransport pair, the tls options are ignored
+func (f *Facade) Connect(L *lua.LState, t Transport, opts *Options) error {
+	return f.start(L, t, opts, func() error {
+		return nil
+	})
+}
+
+func (f *Facade) start(L *lua.LState, t Transport, opts *Options, open func() error) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	f.secret = opts.Secret
+	f.pauseOnEntry = opts.PauseOnEntry
+	f.capture = opts.CaptureOutput
+	f.compressor = NewCompressor(t)
+	f.compressor.MaxFrameSize = opts.MaxFrameSize
+	t = f.compressor
+	if opts.RecordFile != "" {
+		file, err := os.Create(opts.RecordFile)
+		if err != nil {
+			return err
+		}
+		t = NewRecorder(t, file)
+	}
+	f.addState(L)
+	f.t = t
+	f.t.SetHandler(f.HandleMsg)
+	if f.capture {
+		f.captureOutput(L)
+	}
+
+	err := open()
+	for i := 0; err != nil && i < opts.DialRetries; i++ {
+		time.Sleep(opts.RetryInterval)
+		err = open()
+	}
+	if err == nil && opts.ObserverAddr != "" {
+		err = f.ListenObservers(opts.ObserverAddr, opts.TLSConfig)
+	}
+	if err == nil && opts.ControlAddr != "" {
+		err = f.ListenControl(opts.ControlAddr)
+	}
+	if err != nil {
+		f.Stop(L)
+		return err
+	}
+
+	if opts.NonBlocking {
+		// the IDE will come while L is running, let the hook attach it
+		f.lazyAttach = true
+		f.dbg.UpdateHook(L, "clr")
+		return nil
+	}
+	if err := f.waitIDEReady(L, opts.WaitTimeout); err != nil {
+		f.Stop(L)
 		return err
 	}
+	return nil
+}
+
+// waitIDEReady blocks until the IDE is ready, or timeout if it's not 0, or
+// the context of L is done
+func (f *Facade) waitIDEReady(L *lua.LState, timeout time.Duration) error {
 	waitDone := make(chan struct{}, 1)
 	if L.Context() != nil {
 		go f.stopWaitIDEIfContextCanceled(L.Context(), waitDone)
 	}
-	f.WaiteIDE(waitDone, true)
+	expired := false
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			f.m.Lock()
+			expired = true
+			f.cond.Broadcast()
+			f.m.Unlock()
+		})
+		defer timer.Stop()
+	}
+	ctx := L.Context()
+	f.waitIDE(waitDone, true, func() bool {
+		return expired || (ctx != nil && ctx.Err() != nil)
+	})
+
+	if !f.isReady() {
+		return errors.New("IDE is not ready")
+	}
 	return nil
 }
 
@@ -77,18 +260,190 @@ func (f *Facade) stopWaitIDEIfContextCanceled(ctx context.Context, waitDone <-ch
 	}
 }
 
+// WaiteIDE blocks until the IDE is ready or f is closed if force, then
+// signals done
 func (f *Facade) WaiteIDE(done chan<- struct{}, force bool) {
-	if f.t != nil && force && !f.isWaitingForIDE && !f.isIDEReady {
-		f.isWaitingForIDE = true
-		f.m.Lock()
+	f.waitIDE(done, force, nil)
+}
+
+// waitIDE is WaiteIDE giving up when expired returns true too, expired is
+// called with f.m locked at every broadcast of f.cond. Every waiter checks its
+// own conditions, a wakeup for another one doesn't let it go
+func (f *Facade) waitIDE(done chan<- struct{}, force bool, expired func() bool) {
+	f.m.Lock()
+	for f.t != nil && force && !f.isIDEReady && !f.isClosed() && (expired == nil || !expired()) {
 		f.cond.Wait()
-		f.m.Unlock()
-		f.isWaitingForIDE = false
 	}
+	f.m.Unlock()
 	done <- struct{}{}
 }
 
+// BreakHere breaks L at the current line, it does nothing if the IDE is not
+// ready yet
+func (f *Facade) BreakHere(L *lua.LState) bool {
+	if !f.isReady() {
+		return false
+	}
+	f.dbg.HandleBreak(L)
+	return true
+}
+
+// ListenShared serves the IDE on host:port for all the states added by
+// AddState later, it doesn't wait for the IDE. Reconnect is always enabled,
+// with the default policy if opts doesn't have one
+func (f *Facade) ListenShared(host string, port int, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	t := opts.newNetTransport()
+	if t.Reconnect == nil {
+		t.Reconnect = DefaultReconnectPolicy()
+	}
+	f.shared = true
+	f.lazyAttach = true
+	f.secret = opts.Secret
+	f.pauseOnEntry = opts.PauseOnEntry
+	f.capture = opts.CaptureOutput
+	f.compressor = NewCompressor(t)
+	f.compressor.MaxFrameSize = opts.MaxFrameSize
+	f.t = f.compressor
+	f.t.SetHandler(f.HandleMsg)
+	if err := t.Listen(host, port); err != nil {
+		return err
+	}
+	if opts.ObserverAddr != "" {
+		if err := f.ListenObservers(opts.ObserverAddr, opts.TLSConfig); err != nil {
+			_ = t.Close()
+			return err
+		}
+	}
+	if opts.ControlAddr != "" {
+		if err := f.ListenControl(opts.ControlAddr); err != nil {
+			f.closeObservers()
+			_ = t.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// AddState lets L share the debugger, it must be called on the goroutine
+// running L. L is attached in its next hook if the IDE is there
+func (f *Facade) AddState(L *lua.LState) {
+	f.mutexStates.Lock()
+	f.states[L] = struct{}{}
+	f.dbg.UpdateHook(L, "clr")
+	if f.dbg.isRunning() {
+		f.dbg.AttachLater(L)
+	}
+	f.mutexStates.Unlock()
+
+	if f.capture {
+		f.captureOutput(L)
+	}
+}
+
+// RemoveState detaches L from the shared debugger, it must be called on the
+// goroutine running L. The debugger is closed when the last state leaves
+func (f *Facade) RemoveState(L *lua.LState) {
+	sharedMutex.Lock()
+	last := f.removeState(L) == 0
+	if last {
+		// no state can join it from now on
+		unshareFacadeLocked(f)
+	}
+	sharedMutex.Unlock()
+
+	f.dbg.Detach(L)
+	f.restoreOutput(L)
+	if last {
+		f.Close()
+	}
+}
+
+func (f *Facade) addState(L *lua.LState) {
+	f.mutexStates.Lock()
+	f.states[L] = struct{}{}
+	f.mutexStates.Unlock()
+}
+
+// removeState forgets L and returns the number of the states left
+func (f *Facade) removeState(L *lua.LState) int {
+	f.mutexStates.Lock()
+	defer f.mutexStates.Unlock()
+	delete(f.states, L)
+	return len(f.states)
+}
+
+// Stop closes the debugger and detaches L at once, it must be called on the
+// goroutine running L
+func (f *Facade) Stop(L *lua.LState) {
+	f.Close()
+	f.detach(L)
+}
+
+// Close ends the debugging of all the states and closes the connection. The
+// state blocked at a break is released, the queued evals are answered with an
+// error, and every state removes its hooks and its registry entry in its next
+// hook, so it can be attached again. It can be called on any goroutine
+func (f *Facade) Close() {
+	if !atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		return
+	}
+
+	f.dbg.Stop()
+	f.dbg.RemoveAllBreakpoints()
+	f.dbg.storeHookState(nil)
+	f.dbg.ExitDebugMode()
+	f.dbg.rejectEvals("debugger detached")
+
+	f.mutexStates.Lock()
+	f.states = make(map[*lua.LState]struct{})
+	f.mutexStates.Unlock()
+
+	f.m.Lock()
+	f.isIDEReady = false
+	f.m.Unlock()
+	f.cond.Broadcast()
+
+	if f.shared {
+		unshareFacade(f)
+	}
+	f.closeObservers()
+	f.closeControl()
+	if f.t != nil {
+		_ = f.t.Close()
+	}
+}
+
+func (f *Facade) isClosed() bool {
+	return atomic.LoadInt32(&f.closed) != 0
+}
+
+// detach removes the hooks of L and its registry entry if it's still f, it
+// must be called on the goroutine running L
+func (f *Facade) detach(L *lua.LState) {
+	f.dbg.Detach(L)
+	f.restoreOutput(L)
+	if getFacade(L) == f {
+		unregisterFacade(L)
+	}
+}
+
 func (f *Facade) HandleMsg(cmd int, req interface{}) {
+	if f.isClosed() {
+		return
+	}
+	// the local events of the transport are not from the IDE
+	if !f.isAuthenticated() && cmd >= 0 {
+		if cmd == proto.MsgIdAuthReq {
+			f.OnAuthReq(req.(*proto.AuthReq))
+		} else {
+			log.Println("ignore msg before authenticated:", cmd)
+		}
+		return
+	}
+
 	switch cmd {
 	case proto.MsgIdInitReq:
 		f.OnInitReq(req.(*proto.InitReq))
@@ -102,22 +457,167 @@ func (f *Facade) HandleMsg(cmd int, req interface{}) {
 		f.OnActionReq(req.(*proto.ActionReq))
 	case proto.MsgIdEvalReq:
 		f.OnEvalReq(req.(*proto.EvalReq))
+	case proto.MsgIdStackReq:
+		f.OnStackReq(req.(*proto.StackReq))
+	case MsgIdDisconnected:
+		f.OnDisconnected()
+	case MsgIdSendFailed:
+		f.OnSendFailed(req.(error))
+	case MsgIdFrameError:
+		f.OnFrameError(req.(*proto.ErrorNotify))
 	}
 }
 
+func (f *Facade) OnAuthReq(req *proto.AuthReq) {
+	rsp := f.checkSecret(req)
+	f.setAuthenticated(rsp.Success)
+	f.t.Send(proto.MsgIdAuthRsp, rsp)
+	if !rsp.Success {
+		// one guess per connection
+		log.Println("drop the IDE with a wrong secret")
+		f.dropIDE()
+	}
+}
+
+// dropIDE closes the connection of the IDE, the transport accepts another
+// one or reports a Stop action. The debugger is closed if the transport
+// can't drop the connection
+func (f *Facade) dropIDE() {
+	if d, ok := f.compressor.t.(interface{ Drop() }); ok {
+		d.Drop()
+		return
+	}
+	f.Close()
+}
+
+// isAuthenticated reports whether the IDE may talk to the debugger, it's
+// always true without a secret
+func (f *Facade) isAuthenticated() bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.secret == "" || f.authenticated
+}
+
+// isReady reports whether the IDE has sent ReadyReq
+func (f *Facade) isReady() bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.isIDEReady
+}
+
+func (f *Facade) setAuthenticated(authenticated bool) {
+	f.m.Lock()
+	f.authenticated = authenticated
+	f.m.Unlock()
+}
+
+func (f *Facade) checkSecret(req *proto.AuthReq) proto.AuthRsp {
+	rsp := proto.AuthRsp{Success: true}
+	if subtle.ConstantTimeCompare([]byte(req.Secret), []byte(f.secret)) != 1 {
+		rsp.Success = false
+		rsp.Error = "invalid secret"
+	}
+	return rsp
+}
+
 func (f *Facade) OnInitReq(req *proto.InitReq) {
 	f.helperCode = req.EmmyHelper
 	f.dbg.Start(f.helperCode)
 
+	f.dbg.mutexBP.Lock()
+	f.dbg.ExtNames = req.Ext
+	f.dbg.mutexBP.Unlock()
+	ideCaps := make(map[string]struct{})
+	for _, capability := range req.Capabilities {
+		ideCaps[capability] = struct{}{}
+	}
+	// read by the states while they break or log
+	f.m.Lock()
+	f.ideVersion = req.Version
+	f.ideCaps = ideCaps
+	f.m.Unlock()
+	f.t.Send(proto.MsgIdInitRsp, proto.InitRsp{
+		Version:      proto.Version,
+		Capabilities: capabilities,
+	})
+	f.compressor.SetEnabled(f.IDESupports(proto.CapCompress))
+
+	// the states are blocked waiting for the IDE at the first time, but they
+	// may be running when the IDE comes back after a disconnection or when
+	// they don't wait for the IDE
+	f.mutexStates.Lock()
 	for state := range f.states {
-		f.dbg.Attach(state)
+		if f.lazyAttach {
+			f.dbg.AttachLater(state)
+		} else {
+			f.dbg.Attach(state)
+		}
 	}
+	f.mutexStates.Unlock()
+	f.lazyAttach = true
+}
 
-	f.dbg.ExtNames = req.Ext
+// IDESupports reports whether the IDE sent capability in InitReq, it's false
+// for the EmmyLua IDE
+func (f *Facade) IDESupports(capability string) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	_, ok := f.ideCaps[capability]
+	return ok
+}
+
+// OnStop ends the debugging when the IDE stops or the connection is lost for
+// good, the states sharing a listener stay attached for the next IDE
+func (f *Facade) OnStop() {
+	if f.shared {
+		f.OnDisconnected()
+		return
+	}
+	f.Close()
+}
+
+// OnDisconnected keeps the states running without breakpoints until the IDE
+// comes back and sends its breakpoints again
+func (f *Facade) OnDisconnected() {
+	f.m.Lock()
+	f.isIDEReady = false
+	f.m.Unlock()
+	f.setAuthenticated(false)
+	f.dbg.RemoveAllBreakpoints()
+	// a step in progress is dropped too, so it's not a DoAction
+	f.dbg.SetHookState(f.dbg.currentState(), f.dbg.stateContinue)
+}
+
+// OnSendFailed drops the IDE when a message can't reach it, the IDE missed
+// it and can't go on. The transport reports MsgIdDisconnected or a Stop
+// action then
+func (f *Facade) OnSendFailed(err error) {
+	log.Println("send msg to IDE fail:", err)
+	// not dropIDE, Close would wait for the writer which runs the handler
+	if d, ok := f.compressor.t.(interface{ Drop() }); ok {
+		d.Drop()
+	}
+}
+
+// OnFrameError tells the IDE a message it sent is dropped, the transport has
+// logged it already for the IDEs which don't know ErrorNotify
+func (f *Facade) OnFrameError(notify *proto.ErrorNotify) {
+	if f.IDESupports(proto.CapErrorNotify) {
+		f.t.Send(proto.MsgIdErrorNotify, notify)
+	}
 }
 
 func (f *Facade) OnReadyReq() {
+	if f.pauseOnEntry {
+		f.pauseOnEntry = false
+		f.dbg.DoAction(proto.Break)
+	}
+
+	// acknowledged before the states go on
+	f.t.Send(proto.MsgIdReadyRsq, proto.ReadyRsp{Success: true})
+	f.m.Lock()
 	f.isIDEReady = true
+	f.m.Unlock()
 	f.cond.Broadcast()
 }
 
@@ -126,24 +626,45 @@ func (f *Facade) OnAddBreakPointReq(req *proto.AddBreakPointReq) {
 		f.dbg.RemoveAllBreakpoints()
 	}
 
+	var errs []string
 	for _, bpProto := range req.BreakPoints {
 		bp := &BreakPoint{
 			File:      bpProto.File,
 			Condition: bpProto.Condition,
 			Line:      bpProto.Line,
 		}
+		if err := checkBreakPoint(bp); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
 		f.dbg.AddBreakPoint(bp)
 	}
+	f.t.Send(proto.MsgIdAddBreakPointRsp, proto.AddBreakPointRsp{
+		Success: len(errs) == 0,
+		Error:   strings.Join(errs, "; "),
+	})
 }
 
 func (f *Facade) OnRemoveBreakPointReq(req *proto.RemoveBreakPointReq) {
+	var errs []string
 	for _, bp := range req.BreakPoints {
-		f.dbg.RemoveBreakPoint(bp.File, bp.Line)
+		if !f.dbg.RemoveBreakPoint(bp.File, bp.Line) {
+			errs = append(errs, fmt.Sprintf("no breakpoint at %s:%d", bp.File, bp.Line))
+		}
 	}
+	f.t.Send(proto.MsgIdRemoveBreakPointRsp, proto.RemoveBreakPointRsp{
+		Success: len(errs) == 0,
+		Error:   strings.Join(errs, "; "),
+	})
 }
 
 func (f *Facade) OnActionReq(req *proto.ActionReq) {
-	f.dbg.DoAction(req.Action)
+	rsp := proto.ActionRsp{Success: true}
+	if err := f.dbg.DoAction(req.Action); err != nil {
+		rsp.Success = false
+		rsp.Error = err.Error()
+	}
+	f.t.Send(proto.MsgIdActionRsp, rsp)
 }
 
 func (f *Facade) OnEvalReq(req *proto.EvalReq) {
@@ -156,31 +677,54 @@ func (f *Facade) OnEvalReq(req *proto.EvalReq) {
 		Success:    false,
 	}
 
-	f.dbg.Eval(context)
+	if err := f.dbg.Eval(context); err != nil {
+		context.Error = err.Error()
+		f.OnEvalResult(context)
+	}
 }
 
 func (f *Facade) OnBreak(L *lua.LState) {
-	stacks := f.dbg.GetStacks(L)
-
-	notify := proto.BreakNotify{Cmd: proto.MsgIdBreakNotify}
-	for _, stack := range stacks {
-		s := proto.Stack{
-			Level:            stack.Level,
-			File:             stack.File,
-			FunctionName:     stack.FunctionName,
-			Line:             stack.Line,
-			LocalVariables:   []*proto.Variable{},
-			UpvalueVariables: []*proto.Variable{},
+	// the lazy and full notifications are made once at most
+	notifies := map[bool]*proto.BreakNotify{}
+	breakNotify := func(lazy bool) *proto.BreakNotify {
+		if notify, ok := notifies[lazy]; ok {
+			return notify
 		}
-		for _, variable := range stack.LocalVariables {
-			s.LocalVariables = append(s.LocalVariables, variable.toProto())
+		var stacks []*Stack
+		if lazy {
+			stacks = f.dbg.GetLazyStacks(L)
+		} else {
+			stacks = f.dbg.GetStacks(L)
 		}
-		for _, variable := range stack.UpvalueVariables {
-			s.LocalVariables = append(s.LocalVariables, variable.toProto())
+		notify := &proto.BreakNotify{Cmd: proto.MsgIdBreakNotify}
+		for _, stack := range stacks {
+			notify.Stacks = append(notify.Stacks, stack.toProto())
 		}
-		notify.Stacks = append(notify.Stacks, s)
+		notifies[lazy] = notify
+		return notify
+	}
+
+	f.t.Send(proto.MsgIdBreakNotify, breakNotify(f.IDESupports(proto.CapLazyVariables)))
+	f.notifyObservers(proto.MsgIdBreakNotify, func(o *observer) interface{} {
+		return breakNotify(o.supports(proto.CapLazyVariables))
+	})
+}
+
+func (f *Facade) OnStackReq(req *proto.StackReq) {
+	f.t.Send(proto.MsgIdStackRsp, f.stackRsp(req))
+}
+
+func (f *Facade) stackRsp(req *proto.StackReq) proto.StackRsp {
+	rsp := proto.StackRsp{Seq: req.Seq}
+	stack, err := f.dbg.StackAt(req.Level)
+	if err != nil {
+		rsp.Error = err.Error()
+	} else {
+		s := stack.toProto()
+		rsp.Success = true
+		rsp.Stack = &s
 	}
-	f.t.Send(proto.MsgIdBreakNotify, notify)
+	return rsp
 }
 
 func (f *Facade) OnEvalResult(ctx *EvalContext) {
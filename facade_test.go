@@ -1,17 +1,941 @@
 package lua_debugger
 
 import (
+	"errors"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
 	lua "github.com/yuin/gopher-lua"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func TestFacade_TcpConnect(t *testing.T) {
+const testScript = `connect()
+local a = 1
+local b = a + 1
+result = b
+`
+
+func TestFacade_Connect(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	ide.start(nil, proto.BreakPoint{File: "test.lua", Line: 3})
+
+	L := lua.NewState()
+	defer L.Close()
+	done := runTestScript(t, L, dbgSide, nil)
+	ide.expectStarted()
+
+	notify := ide.expectBreak()
+	level := -1
+	for _, stack := range notify.Stacks {
+		if stack.File == "test.lua" {
+			if stack.Line != 3 {
+				t.Fatal("break at wrong line", stack.Line)
+			}
+			level = stack.Level
+			break
+		}
+	}
+	if level < 0 {
+		t.Fatal("no lua stack in break notify", notify)
+	}
+
+	ide.Send(proto.MsgIdEvalReq, proto.EvalReq{Seq: 1, Expr: "a + 1", StackLevel: level, Depth: 1})
+	rsp := ide.expect(&proto.EvalRsp{}).(*proto.EvalRsp)
+	if !rsp.Success || rsp.Value.Value != "2" {
+		t.Fatal("unexpected eval rsp", rsp)
+	}
+
+	ide.action(proto.Continue)
+	expectScriptDone(t, L, done)
+}
+
+func TestFacade_ConditionBreakpoint(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	ide.start(nil,
+		proto.BreakPoint{File: "test.lua", Line: 3, Condition: "a == 2"},
+		proto.BreakPoint{File: "test.lua", Line: 4, Condition: "b == 2"},
+	)
+
+	L := lua.NewState()
+	defer L.Close()
+	done := runTestScript(t, L, dbgSide, nil)
+	ide.expectStarted()
+
+	notify := ide.expectBreak()
+	for _, stack := range notify.Stacks {
+		if stack.File == "test.lua" && stack.Line != 4 {
+			t.Fatal("break at wrong line", stack.Line)
+		}
+	}
+
+	ide.action(proto.Continue)
+	expectScriptDone(t, L, done)
+}
+
+func TestFacade_Acks(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+
+	L := lua.NewState()
+	defer L.Close()
+	done := runTestScript(t, L, dbgSide, nil)
+
+	ide.Send(proto.MsgIdInitReq, proto.InitReq{Ext: []string{".lua"}})
+	ide.expect(&proto.InitRsp{})
+
+	ide.Send(proto.MsgIdAddBreakPointReq, proto.AddBreakPointReq{
+		BreakPoints: []proto.BreakPoint{
+			{File: "test.lua", Line: 0},
+			{File: "test.lua", Line: 2, Condition: "a =="},
+			{File: "test.lua", Line: 3},
+		},
+	})
+	addRsp := ide.expect(&proto.AddBreakPointRsp{}).(*proto.AddBreakPointRsp)
+	if addRsp.Success || !strings.Contains(addRsp.Error, "invalid line") || !strings.Contains(addRsp.Error, "invalid condition") {
+		t.Fatal("unexpected add rsp", addRsp)
+	}
+
+	ide.Send(proto.MsgIdRemoveBreakPointReq, proto.RemoveBreakPointReq{
+		BreakPoints: []proto.BreakPoint{{File: "test.lua", Line: 2}},
+	})
+	if rsp := ide.expect(&proto.RemoveBreakPointRsp{}).(*proto.RemoveBreakPointRsp); rsp.Success || rsp.Error == "" {
+		t.Fatal("unexpected remove rsp", rsp)
+	}
+
+	ide.Send(proto.MsgIdActionReq, proto.ActionReq{Action: proto.StepOver})
+	if rsp := ide.expect(&proto.ActionRsp{}).(*proto.ActionRsp); rsp.Success || rsp.Error != "not at a break" {
+		t.Fatal("unexpected action rsp", rsp)
+	}
+	ide.Send(proto.MsgIdEvalReq, proto.EvalReq{Seq: 1, Expr: "a"})
+	if rsp := ide.expect(&proto.EvalRsp{}).(*proto.EvalRsp); rsp.Success || rsp.Seq != 1 || rsp.Error != "not at a break" {
+		t.Fatal("unexpected eval rsp", rsp)
+	}
+
+	ide.Send(proto.MsgIdReadyReq, proto.ReadyReq{})
+	if rsp := ide.expect(&proto.ReadyRsp{}).(*proto.ReadyRsp); !rsp.Success {
+		t.Fatal("unexpected ready rsp", rsp)
+	}
+	ide.expectBreak()
+	ide.action(proto.Continue)
+	expectScriptDone(t, L, done)
+}
+
+func TestFacade_Secret(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+
+	L := lua.NewState()
+	defer L.Close()
+	done := runTestScript(t, L, dbgSide, &Options{Secret: "s3cret"})
+
+	ide.Send(proto.MsgIdReadyReq, proto.ReadyReq{})
+	ide.Send(proto.MsgIdAuthReq, proto.AuthReq{Secret: "s3cret"})
+	if rsp := ide.expect(&proto.AuthRsp{}).(*proto.AuthRsp); !rsp.Success {
+		t.Fatal("secret rejected", rsp.Error)
+	}
+	select {
+	case <-done:
+		t.Fatal("ready req accepted before authenticated")
+	default:
+	}
+
+	ide.start(nil)
+	ide.expectStarted()
+	expectScriptDone(t, L, done)
+}
+
+func TestFacade_WrongSecret(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := Connect(L, dbgSide, &Options{Secret: "s3cret"}); err == nil {
+			t.Error("connected with a wrong secret")
+		}
+		return 0
+	}))
+	done := make(chan error, 1)
+	go func() {
+		done <- L.DoString(testScript)
+	}()
+
+	// a MemTransport can't drop the IDE, the debugger is closed with it
+	ide.Send(proto.MsgIdAuthReq, proto.AuthReq{Secret: "wrong"})
+	if rsp := ide.expect(&proto.AuthRsp{}).(*proto.AuthRsp); rsp.Success {
+		t.Fatal("wrong secret accepted")
+	}
+	ide.expectDropped()
+	expectScriptDone(t, L, done)
+}
+
+func TestFacade_WrongSecretListen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	if err := Attach(L, &AttachOptions{
+		Options: Options{NonBlocking: true, Secret: "s3cret", Reconnect: DefaultReconnectPolicy()},
+		Mode:    "tcpListen",
+		Addr:    addr,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer Detach(L)
+
+	connect := func(secret string) *testIDE {
+		trans := &NetTransport{}
+		ide := newTestIDE(t, trans)
+		if err := trans.dial("tcp", addr); err != nil {
+			t.Fatal(err)
+		}
+		ide.Send(proto.MsgIdAuthReq, proto.AuthReq{Secret: secret})
+		if rsp := ide.expect(&proto.AuthRsp{}).(*proto.AuthRsp); rsp.Success != (secret == "s3cret") {
+			t.Fatal("unexpected auth rsp", rsp)
+		}
+		return ide
+	}
+
+	// one guess per connection, then the next IDE is accepted
+	ide := connect("wrong")
+	ide.expectDropped()
+	_ = ide.Close()
+
+	ide = connect("s3cret")
+	ide.start(nil)
+	ide.expectStarted()
+}
+
+func TestFacade_Reconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	if err := Attach(L, &AttachOptions{
+		Options: Options{NonBlocking: true, Reconnect: DefaultReconnectPolicy()},
+		Mode:    "tcpListen",
+		Addr:    addr,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer Detach(L)
+	stopped := false
+	L.SetGlobal("stopLoop", L.NewFunction(func(L *lua.LState) int {
+		stopped = true
+		return 0
+	}))
+	L.SetGlobal("stopped", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(stopped))
+		return 1
+	}))
+	done := make(chan error, 1)
+	go func() {
+		done <- L.DoString(`while not stopped() do
+				local x = 1
+			end`)
+	}()
+
+	connect := func() *testIDE {
+		trans := &NetTransport{}
+		ide := newTestIDE(t, trans)
+		if err := trans.dial("tcp", addr); err != nil {
+			t.Fatal(err)
+		}
+		return ide
+	}
+
+	ide := connect()
+	ide.start(nil, proto.BreakPoint{File: "<string>", Line: 2})
+	ide.expectStarted()
+	ide.expectBreak()
+	ide.Send(proto.MsgIdRemoveBreakPointReq, proto.RemoveBreakPointReq{
+		BreakPoints: []proto.BreakPoint{{File: "<string>", Line: 2}},
+	})
+	ide.expect(&proto.RemoveBreakPointRsp{})
+	ide.action(proto.Continue)
+	_ = ide.Close()
+
+	// the state runs on without the IDE, and resumes with the breakpoints
+	// sent by the next one
+	ide = connect()
+	ide.start(nil, proto.BreakPoint{File: "<string>", Line: 2})
+	ide.expectStarted()
+	for _, stack := range ide.expectBreak().Stacks {
+		if stack.File == "<string>" && stack.Line != 2 {
+			t.Fatal("break at wrong line", stack.Line)
+		}
+	}
+	ide.Send(proto.MsgIdEvalReq, proto.EvalReq{Seq: 1, Expr: "stopLoop()", StackLevel: 1})
+	if rsp := ide.expect(&proto.EvalRsp{}).(*proto.EvalRsp); !rsp.Success {
+		t.Fatal("eval fail", rsp.Error)
+	}
+	ide.Send(proto.MsgIdRemoveBreakPointReq, proto.RemoveBreakPointReq{
+		BreakPoints: []proto.BreakPoint{{File: "<string>", Line: 2}},
+	})
+	ide.expect(&proto.RemoveBreakPointRsp{})
+	ide.action(proto.Continue)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lua not continued")
+	}
+}
+
+func TestFacade_NonBlocking(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := Connect(L, dbgSide, &Options{NonBlocking: true}); err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+	stopped := false
+	L.SetGlobal("stopLoop", L.NewFunction(func(L *lua.LState) int {
+		stopped = true
+		return 0
+	}))
+	L.SetGlobal("stopped", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(stopped))
+		return 1
+	}))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- L.DoString(`connect()
+			while not stopped() do
+				local x = 1
+			end`)
+	}()
+
+	// the IDE comes while the script is running
+	ide.start(nil, proto.BreakPoint{File: "<string>", Line: 3})
+	ide.expectStarted()
+
+	ide.expectBreak()
+	ide.Send(proto.MsgIdEvalReq, proto.EvalReq{Seq: 1, Expr: "stopLoop()", StackLevel: 1})
+	if rsp := ide.expect(&proto.EvalRsp{}).(*proto.EvalRsp); !rsp.Success {
+		t.Fatal("eval fail", rsp.Error)
+	}
+	ide.Send(proto.MsgIdRemoveBreakPointReq, proto.RemoveBreakPointReq{
+		BreakPoints: []proto.BreakPoint{{File: "<string>", Line: 3}},
+	})
+	if rsp := ide.expect(&proto.RemoveBreakPointRsp{}).(*proto.RemoveBreakPointRsp); !rsp.Success {
+		t.Fatal("unexpected remove rsp", rsp)
+	}
+	ide.action(proto.Continue)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lua not continued")
+	}
+}
+
+func TestFacade_SharedStep(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+
+	var stopped int32
+	newState := func() *lua.LState {
+		L := lua.NewState()
+		L.SetGlobal("stopped", L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LBool(atomic.LoadInt32(&stopped) != 0))
+			return 1
+		}))
+		return L
+	}
+	run := func(L *lua.LState, name, script string) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			fn, err := L.Load(strings.NewReader(script), name)
+			if err == nil {
+				L.Push(fn)
+				err = L.PCall(0, 0, nil)
+			}
+			done <- err
+		}()
+		return done
+	}
+
+	L1 := newState()
+	defer L1.Close()
+	connected := make(chan *Facade, 1)
+	L1.SetGlobal("connect", L1.NewFunction(func(L *lua.LState) int {
+		if err := Connect(L, dbgSide, &Options{NonBlocking: true}); err != nil {
+			t.Error(err)
+		}
+		connected <- getFacade(L)
+		return 0
+	}))
+	done1 := run(L1, "one.lua", `connect()
+		while not stopped() do
+			local x = 1
+		end`)
+	fcd := <-connected
+
+	// the second state runs its hooks while the first one steps
+	L2 := newState()
+	defer L2.Close()
+	L2.SetGlobal("join", L2.NewFunction(func(L *lua.LState) int {
+		fcd.AddState(L)
+		return 0
+	}))
+	L2.SetGlobal("leave", L2.NewFunction(func(L *lua.LState) int {
+		fcd.RemoveState(L)
+		return 0
+	}))
+	done2 := run(L2, "two.lua", `join()
+		while not stopped() do
+			local y = 1
+		end
+		leave()`)
+
+	ide.start(nil, proto.BreakPoint{File: "one.lua", Line: 3})
+	ide.expectStarted()
+	ide.expectBreak()
+	for i := 0; i < 10; i++ {
+		ide.action(proto.StepOver)
+		for _, stack := range ide.expectBreak().Stacks {
+			if stack.File == "two.lua" {
+				t.Fatal("break in another state")
+			}
+		}
+	}
+
+	atomic.StoreInt32(&stopped, 1)
+	ide.Send(proto.MsgIdRemoveBreakPointReq, proto.RemoveBreakPointReq{
+		BreakPoints: []proto.BreakPoint{{File: "one.lua", Line: 3}},
+	})
+	ide.expect(&proto.RemoveBreakPointRsp{})
+	ide.action(proto.Continue)
+	for _, done := range []<-chan error{done1, done2} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("lua not done")
+		}
+	}
+}
+
+func TestFacade_Stop(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	for i := 0; i < 2; i++ {
+		ide, dbgSide := newMemTestIDE(t)
+		ide.start(nil, proto.BreakPoint{File: "test.lua", Line: 3})
+
+		// the state is attached again after the IDE stops the previous session
+		done := runTestScript(t, L, dbgSide, nil)
+		ide.expectStarted()
+		ide.expectBreak()
+		ide.Send(proto.MsgIdActionReq, proto.ActionReq{Action: proto.Stop})
+		expectScriptDone(t, L, done)
+
+		if getFacade(L) != nil {
+			t.Fatal("facade not unregistered")
+		}
+		_ = ide.Close()
+	}
+}
+
+func TestFacade_Capabilities(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	ide.Send(proto.MsgIdInitReq, proto.InitReq{
+		Ext:          []string{".lua"},
+		Version:      proto.Version,
+		Capabilities: []string{proto.CapEval, "unknown"},
+	})
+	ide.Send(proto.MsgIdReadyReq, proto.ReadyReq{})
+
 	L := lua.NewState()
-	f := Facade{}
-	if err:= f.TcpConnect(L, "localhost", 9966); err != nil {
+	defer L.Close()
+	var fcd *Facade
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := Connect(L, dbgSide, nil); err != nil {
+			t.Error(err)
+		}
+		fcd = getFacade(L)
+		return 0
+	}))
+	if err := L.DoString("connect()"); err != nil {
 		t.Fatal(err)
 	}
 
-	time.Sleep(1000 * time.Second)
+	rsp := ide.expect(&proto.InitRsp{}).(*proto.InitRsp)
+	if rsp.Version != proto.Version || len(rsp.Capabilities) == 0 {
+		t.Fatal("unexpected init rsp", rsp)
+	}
+	ide.expect(&proto.ReadyRsp{})
+	if !fcd.IDESupports(proto.CapEval) || fcd.IDESupports(proto.CapAuth) {
+		t.Fatal("unexpected IDE capabilities", fcd.ideCaps)
+	}
+}
+
+func TestFacade_InitAgain(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := Connect(L, dbgSide, &Options{NonBlocking: true}); err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+	stopped := false
+	L.SetGlobal("stopLoop", L.NewFunction(func(L *lua.LState) int {
+		stopped = true
+		return 0
+	}))
+	L.SetGlobal("stopped", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(stopped))
+		return 1
+	}))
+	done := make(chan error, 1)
+	go func() {
+		done <- L.DoString(`connect()
+			while not stopped() do
+				local x = 1
+			end`)
+	}()
+
+	ide.start(nil, proto.BreakPoint{File: "<string>", Line: 3})
+	ide.expectStarted()
+	ide.expectBreak()
+
+	// the capabilities change while the state goes on to the next break
+	ide.Send(proto.MsgIdActionReq, proto.ActionReq{Action: proto.Continue})
+	ide.Send(proto.MsgIdInitReq, proto.InitReq{Ext: []string{".lua"}, Capabilities: []string{proto.CapLazyVariables}})
+	got := map[reflect.Type]int{}
+	for i := 0; i < 3; i++ {
+		got[reflect.TypeOf(ide.next())]++
+	}
+	for _, want := range []interface{}{&proto.ActionRsp{}, &proto.InitRsp{}, &proto.BreakNotify{}} {
+		if got[reflect.TypeOf(want)] != 1 {
+			t.Fatal("unexpected msgs", got)
+		}
+	}
+
+	ide.Send(proto.MsgIdEvalReq, proto.EvalReq{Seq: 1, Expr: "stopLoop()", StackLevel: 1})
+	if rsp := ide.expect(&proto.EvalRsp{}).(*proto.EvalRsp); !rsp.Success {
+		t.Fatal("eval fail", rsp.Error)
+	}
+	ide.Send(proto.MsgIdRemoveBreakPointReq, proto.RemoveBreakPointReq{
+		BreakPoints: []proto.BreakPoint{{File: "<string>", Line: 3}},
+	})
+	ide.expect(&proto.RemoveBreakPointRsp{})
+	ide.action(proto.Continue)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lua not continued")
+	}
+}
+
+func TestFacade_LazyVariables(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	ide.start([]string{proto.CapLazyVariables}, proto.BreakPoint{File: "test.lua", Line: 3})
+
+	L := lua.NewState()
+	defer L.Close()
+	done := runTestScript(t, L, dbgSide, nil)
+	ide.expectStarted()
+
+	notify := ide.expectBreak()
+	withVariables := 0
+	for _, stack := range notify.Stacks {
+		if len(stack.LocalVariables) > 0 {
+			withVariables++
+		}
+	}
+	if withVariables != 1 {
+		t.Fatal("variables of more than the top frame sent", notify)
+	}
+
+	ide.Send(proto.MsgIdStackReq, proto.StackReq{Seq: 1, Level: 1})
+	rsp := ide.expect(&proto.StackRsp{}).(*proto.StackRsp)
+	if !rsp.Success || rsp.Stack.Line != 3 || len(rsp.Stack.LocalVariables) == 0 {
+		t.Fatal("unexpected stack rsp", rsp)
+	}
+
+	ide.action(proto.Continue)
+	expectScriptDone(t, L, done)
+}
+
+func TestFacade_FrameError(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	// only told with the capability
+	ide.Send(proto.MsgIdInitReq, proto.InitReq{Ext: []string{".lua"}})
+	ide.Send(999, struct{}{})
+	ide.Send(proto.MsgIdInitReq, proto.InitReq{Ext: []string{".lua"}, Capabilities: []string{proto.CapErrorNotify}})
+	ide.Send(998, struct{}{})
+	ide.Send(proto.MsgIdBreakNotify, proto.BreakNotify{})
+	ide.Send(proto.MsgIdReadyReq, proto.ReadyReq{})
+
+	L := lua.NewState()
+	defer L.Close()
+	done := runTestScript(t, L, dbgSide, nil)
+
+	ide.expect(&proto.InitRsp{})
+	ide.expect(&proto.InitRsp{})
+	// a message of the debugger is unknown too
+	for _, cmd := range []int{998, proto.MsgIdBreakNotify} {
+		if notify := ide.expect(&proto.ErrorNotify{}).(*proto.ErrorNotify); notify.Cmd != cmd {
+			t.Fatal("unexpected error notify", notify)
+		}
+	}
+	ide.expect(&proto.ReadyRsp{})
+	expectScriptDone(t, L, done)
+}
+
+// dropTransport counts the drops of the IDE
+type dropTransport struct {
+	*MemTransport
+	drops int32
+}
+
+func (t *dropTransport) Drop() {
+	atomic.AddInt32(&t.drops, 1)
+}
+
+func TestFacade_SendFailed(t *testing.T) {
+	_, dbgSide := newMemTestIDE(t)
+	trans := &dropTransport{MemTransport: dbgSide}
+
+	L := lua.NewState()
+	defer L.Close()
+	fcd := newFacade()
+	if err := fcd.Connect(L, trans, &Options{NonBlocking: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer fcd.Close()
+
+	fcd.HandleMsg(MsgIdSendFailed, errors.New("i/o timeout"))
+	if atomic.LoadInt32(&trans.drops) != 1 {
+		t.Fatal("the IDE missed a message but is not dropped")
+	}
+}
+
+func TestFacade_Observer(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	obs, obsDbgSide := newMemTestIDE(t)
+	ide.start(nil, proto.BreakPoint{File: "test.lua", Line: 3})
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := Connect(L, dbgSide, nil); err != nil {
+			t.Error(err)
+		}
+		if err := Observe(L, obsDbgSide); err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+	done := make(chan error, 1)
+	go func() {
+		fn, err := L.Load(strings.NewReader(testScript), "test.lua")
+		if err == nil {
+			L.Push(fn)
+			err = L.PCall(0, 0, nil)
+		}
+		done <- err
+	}()
+
+	ide.expectStarted()
+	ide.expectBreak()
+	obs.expectBreak()
+
+	// the observer can look but not touch
+	obs.Send(proto.MsgIdInitReq, proto.InitReq{Capabilities: []string{proto.CapErrorNotify}})
+	obs.expect(&proto.InitRsp{})
+	obs.Send(proto.MsgIdStackReq, proto.StackReq{Seq: 1, Level: 1})
+	if rsp := obs.expect(&proto.StackRsp{}).(*proto.StackRsp); !rsp.Success {
+		t.Fatal("unexpected stack rsp", rsp)
+	}
+	obs.Send(proto.MsgIdActionReq, proto.ActionReq{Action: proto.Continue})
+	if notify := obs.expect(&proto.ErrorNotify{}).(*proto.ErrorNotify); notify.Cmd != proto.MsgIdActionReq {
+		t.Fatal("action of observer not rejected", notify)
+	}
+	select {
+	case <-done:
+		t.Fatal("continued by observer")
+	default:
+	}
+
+	ide.action(proto.Continue)
+	expectScriptDone(t, L, done)
+}
+
+func TestFacade_WaitIDE(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	f := newFacade()
+	f.t = dbgSide
+
+	// every waiter waits for itself, the timeout of one doesn't wake the others
+	wait := func(timeout time.Duration) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			L := lua.NewState()
+			defer L.Close()
+			done <- f.waitIDEReady(L, timeout)
+		}()
+		return done
+	}
+	first, second := wait(0), wait(0)
+	if err := <-wait(50 * time.Millisecond); err == nil {
+		t.Fatal("ready before the IDE")
+	}
+	select {
+	case <-first:
+		t.Fatal("first waiter returned before the IDE is ready")
+	case <-second:
+		t.Fatal("second waiter returned before the IDE is ready")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	f.OnReadyReq()
+	ide.expect(&proto.ReadyRsp{})
+	for _, done := range []<-chan error{first, second} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiter not woken")
+		}
+	}
+}
+
+func TestFacade_ObserverAuth(t *testing.T) {
+	_, dbgSide := newMemTestIDE(t)
+	obs, obsDbgSide := newMemTestIDE(t)
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := Connect(L, dbgSide, &Options{Secret: "s3cret", CaptureOutput: true, NonBlocking: true}); err != nil {
+			t.Error(err)
+		}
+		if err := Observe(L, obsDbgSide); err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+	writes := 0
+	L.SetGlobal("more", L.NewFunction(func(L *lua.LState) int {
+		writes++
+		L.Push(lua.LBool(writes <= 200))
+		return 1
+	}))
+	done := make(chan error, 1)
+	go func() {
+		done <- L.DoString(`connect()
+			while more() do
+				io.write("")
+			end`)
+	}()
+
+	// the observer authenticates while the state writes its output
+	obs.Send(proto.MsgIdAuthReq, proto.AuthReq{Secret: "s3cret"})
+	for {
+		msg := obs.next()
+		if _, ok := msg.(*proto.LogNotify); ok {
+			continue
+		}
+		if rsp, ok := msg.(*proto.AuthRsp); !ok || !rsp.Success {
+			t.Fatal("unexpected msg", msg)
+		}
+		break
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lua not done")
+	}
+}
+
+// runTestScript runs testScript in a new goroutine, the script connects to
+// the IDE through t at the first line
+func runTestScript(t *testing.T, L *lua.LState, trans Transport, opts *Options) <-chan error {
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := Connect(L, trans, opts); err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+
+	done := make(chan error, 1)
+	go func() {
+		fn, err := L.Load(strings.NewReader(testScript), "test.lua")
+		if err == nil {
+			L.Push(fn)
+			err = L.PCall(0, 0, nil)
+		}
+		done <- err
+	}()
+	return done
+}
+
+func expectScriptDone(t *testing.T, L *lua.LState, done <-chan error) {
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lua not continued")
+	}
+	if L.GetGlobal("result").String() != "2" {
+		t.Fatal("unexpected result", L.GetGlobal("result"))
+	}
+}
+
+// testIDE is the IDE side of the tests in the package, unlike emmytest it
+// fails on any message the test doesn't expect
+type testIDE struct {
+	Transport
+	t       *testing.T
+	msgs    chan interface{}
+	backlog []interface{}
+	bps     bool
+}
+
+// newTestIDE talks to the debugger through trans, which is closed at the end
+// of the test. The local events like MsgIdDisconnected are dropped
+func newTestIDE(t *testing.T, trans Transport) *testIDE {
+	ide := &testIDE{Transport: trans, t: t, msgs: make(chan interface{}, 64)}
+	trans.SetHandler(func(cmd int, msg interface{}) {
+		if cmd >= 0 {
+			ide.msgs <- msg
+		}
+	})
+	t.Cleanup(func() {
+		_ = trans.Close()
+	})
+	return ide
+}
+
+// newMemTestIDE returns a testIDE on a MemTransportPair and the debugger end
+func newMemTestIDE(t *testing.T) (*testIDE, *MemTransport) {
+	dbgSide, ideSide := NewMemTransportPair()
+	return newTestIDE(t, ideSide), dbgSide
+}
+
+// start sends the requests of an IDE starting a session, expectStarted
+// checks the responses
+func (ide *testIDE) start(capabilities []string, bps ...proto.BreakPoint) {
+	ide.Send(proto.MsgIdInitReq, proto.InitReq{Ext: []string{".lua"}, Capabilities: capabilities})
+	if len(bps) > 0 {
+		ide.Send(proto.MsgIdAddBreakPointReq, proto.AddBreakPointReq{BreakPoints: bps})
+		ide.bps = true
+	}
+	ide.Send(proto.MsgIdReadyReq, proto.ReadyReq{})
+}
+
+func (ide *testIDE) expectStarted() {
+	ide.t.Helper()
+	ide.expect(&proto.InitRsp{})
+	if ide.bps {
+		if rsp := ide.expect(&proto.AddBreakPointRsp{}).(*proto.AddBreakPointRsp); !rsp.Success {
+			ide.t.Fatal("add breakpoint fail:", rsp.Error)
+		}
+	}
+	if rsp := ide.expect(&proto.ReadyRsp{}).(*proto.ReadyRsp); !rsp.Success {
+		ide.t.Fatal("ready fail")
+	}
+}
+
+// next returns the message kept by action first, then the received one
+func (ide *testIDE) next() interface{} {
+	ide.t.Helper()
+	if len(ide.backlog) > 0 {
+		msg := ide.backlog[0]
+		ide.backlog = ide.backlog[1:]
+		return msg
+	}
+	return ide.receive()
+}
+
+func (ide *testIDE) receive() interface{} {
+	ide.t.Helper()
+	select {
+	case msg := <-ide.msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		ide.t.Fatal("msg not received")
+	}
+	return nil
+}
+
+// expect returns the next message, which must have the type of want
+func (ide *testIDE) expect(want interface{}) interface{} {
+	ide.t.Helper()
+	msg := ide.next()
+	if reflect.TypeOf(msg) != reflect.TypeOf(want) {
+		ide.t.Fatalf("unexpected msg %T %+v, expect %T", msg, msg, want)
+	}
+	return msg
+}
+
+func (ide *testIDE) expectBreak() *proto.BreakNotify {
+	ide.t.Helper()
+	return ide.expect(&proto.BreakNotify{}).(*proto.BreakNotify)
+}
+
+// expectDropped waits for the Stop action reported when the debugger drops
+// the connection
+func (ide *testIDE) expectDropped() {
+	ide.t.Helper()
+	if req := ide.expect(&proto.ActionReq{}).(*proto.ActionReq); req.Action != proto.Stop {
+		ide.t.Fatal("connection not dropped", req)
+	}
+}
+
+// action does the action and checks the response. The state goes on before
+// the response is sent, so what it sends in between is kept for next
+func (ide *testIDE) action(action proto.DebugAction) {
+	ide.t.Helper()
+	ide.Send(proto.MsgIdActionReq, proto.ActionReq{Action: action})
+	for {
+		msg := ide.receive()
+		if rsp, ok := msg.(*proto.ActionRsp); ok {
+			if !rsp.Success {
+				ide.t.Fatal("action fail:", rsp.Error)
+			}
+			return
+		}
+		ide.backlog = append(ide.backlog, msg)
+	}
 }
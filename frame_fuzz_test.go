@@ -0,0 +1,39 @@
+//go:build go1.18
+// +build go1.18
+
+package lua_debugger
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"testing"
+)
+
+// FuzzReadFrame checks the parser never panics or stalls on any input, the
+// corpus is in testdata/fuzz/FuzzReadFrame
+func FuzzReadFrame(f *testing.F) {
+	f.Add([]byte("1\n{\"emmyHelper\":\"\",\"ext\":[\".lua\"]}\n"))
+	f.Add([]byte("11\n{\"seq\":1,\"expr\":\"a\"}\n3\n{}\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReaderSize(bytes.NewReader(data), 16)
+		// every call consumes at least a line
+		for i := 0; i <= len(data); i++ {
+			cmd, msg, err := readFrame(r, 64, proto.GetReq)
+			if fe, ok := err.(*frameError); ok {
+				if fe.err == nil {
+					t.Fatal("frame error without reason")
+				}
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if msg == nil {
+				t.Fatal("no msg for cmd", cmd)
+			}
+		}
+		t.Fatal("input not consumed")
+	})
+}
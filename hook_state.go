@@ -80,7 +80,7 @@ func (h *HookStateStepIn) Start(debugger *Debugger, current *lua.LState) bool {
 
 	_, err := current.GetInfo("nSl", ar, nil)
 	if err != nil {
-		log.Println("StepIn:Start, get info fail:", err)
+		debugger.logln(proto.LogError, "StepIn:Start, get info fail:", err)
 		return false
 	}
 
@@ -91,6 +91,10 @@ func (h *HookStateStepIn) Start(debugger *Debugger, current *lua.LState) bool {
 }
 
 func (h *HookStateStepIn) ProcessHook(debugger *Debugger, L *lua.LState, ar *Ar) {
+	// other states sharing the debugger don't step
+	if L != h.currentL {
+		return
+	}
 	h.UpdateStackLevel(debugger, L, ar)
 	if ar.Event == Lua_HookLine && ar.CurrentLine != h.line {
 		debugger.HandleBreak(L)
@@ -113,6 +117,9 @@ func (h *HookStateStepOut) Start(debugger *Debugger, current *lua.LState) bool {
 }
 
 func (h *HookStateStepOut) ProcessHook(debugger *Debugger, L *lua.LState, ar *Ar) {
+	if L != h.currentL {
+		return
+	}
 	h.UpdateStackLevel(debugger, L, ar)
 	if h.newStackLevel < h.oriStackLevel {
 		debugger.HandleBreak(L)
@@ -133,12 +140,12 @@ func (h *HookStateStepOver) Start(debugger *Debugger, current *lua.LState) bool
 	}
 	ar, ok := current.GetStack(0)
 	if !ok {
-		log.Println("HookStateStepOver:Start, get stack fail")
+		debugger.logln(proto.LogError, "HookStateStepOver:Start, get stack fail")
 		return false
 	}
 	_, err := current.GetInfo("nSl", ar, nil)
 	if err != nil {
-		log.Println("HookStateStepOver:Start, get info fail:", err)
+		debugger.logln(proto.LogError, "HookStateStepOver:Start, get info fail:", err)
 	}
 
 	h.file = ar.Source
@@ -148,6 +155,9 @@ func (h *HookStateStepOver) Start(debugger *Debugger, current *lua.LState) bool
 }
 
 func (h *HookStateStepOver) ProcessHook(debugger *Debugger, L *lua.LState, ar *Ar) {
+	if L != h.currentL {
+		return
+	}
 	h.UpdateStackLevel(debugger, L, ar)
 
 	if h.newStackLevel < h.oriStackLevel {
@@ -186,10 +196,6 @@ type HookStateStop struct {
 }
 
 func (h *HookStateStop) Start(debugger *Debugger, current *lua.LState) bool {
-	if current == nil {
-		return false
-	}
-	debugger.UpdateHook(current, "")
-	debugger.DoAction(proto.Continue)
-	return true
+	debugger.fcd.OnStop()
+	return false
 }
@@ -0,0 +1,125 @@
+package lua_debugger
+
+import (
+	"encoding/json"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"log"
+	"sync"
+)
+
+type memMsg struct {
+	cmd  int
+	data []byte
+}
+
+// MemTransport is an in-memory Transport, the messages are encoded as json
+// just like NetTransport so the peer receives the same types as from a socket
+type MemTransport struct {
+	peer    *MemTransport
+	in      chan memMsg
+	done    chan struct{}
+	once    *sync.Once
+	closed  bool
+	handler func(int, interface{})
+	start   sync.Once
+	// requestsOnly is set on the debugger end, see NetTransport.newMsg
+	requestsOnly bool
+}
+
+// NewMemTransportPair returns two connected transports, one for the debugger
+// and one for the IDE side. The debugger end drops the messages only the
+// debugger sends, like the transports made by the facade
+func NewMemTransportPair() (*MemTransport, *MemTransport) {
+	done := make(chan struct{})
+	once := &sync.Once{}
+	a := &MemTransport{in: make(chan memMsg, 128), done: done, once: once, requestsOnly: true}
+	b := &MemTransport{in: make(chan memMsg, 128), done: done, once: once}
+	a.peer = b
+	b.peer = a
+	return a, b
+}
+
+// SetHandler sets the handler and starts to deliver the received messages,
+// the messages sent before are kept in order
+func (t *MemTransport) SetHandler(handler func(int, interface{})) {
+	t.handler = handler
+	t.start.Do(func() {
+		go t.dispatch()
+	})
+}
+
+func (t *MemTransport) dispatch() {
+	for {
+		select {
+		case m := <-t.in:
+			t.deliver(m)
+		case <-t.done:
+			if !t.closed {
+				// like a socket, what the peer sent before closing is received
+				t.drain()
+				t.handler(proto.MsgIdActionReq, &proto.ActionReq{Action: proto.Stop})
+			}
+			return
+		}
+	}
+}
+
+func (t *MemTransport) drain() {
+	for {
+		select {
+		case m := <-t.in:
+			t.deliver(m)
+		default:
+			return
+		}
+	}
+}
+
+func (t *MemTransport) deliver(m memMsg) {
+	msg := t.newMsg(m.cmd)
+	if msg == nil {
+		t.reject(m.cmd, "unknown cmd")
+		return
+	}
+	if err := json.Unmarshal(m.data, msg); err != nil {
+		t.reject(m.cmd, err.Error())
+		return
+	}
+	t.handler(m.cmd, msg)
+}
+
+func (t *MemTransport) newMsg(cmd int) interface{} {
+	if t.requestsOnly {
+		return proto.GetReq(cmd)
+	}
+	return proto.GetMsg(cmd)
+}
+
+// reject reports the dropped message to the handler, like NetTransport
+func (t *MemTransport) reject(cmd int, reason string) {
+	log.Println("drop msg:", cmd, reason)
+	t.handler(MsgIdFrameError, &proto.ErrorNotify{Cmd: cmd, Error: reason})
+}
+
+func (t *MemTransport) Send(cmd int, msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("send msg fail:", err)
+		return
+	}
+
+	select {
+	case t.peer.in <- memMsg{cmd: cmd, data: data}:
+	case <-t.done:
+	}
+}
+
+// Close closes both ends, the handler of the peer is notified with a Stop
+// action like the socket is broken
+func (t *MemTransport) Close() error {
+	t.once.Do(func() {
+		t.closed = true
+		close(t.done)
+	})
+	return nil
+}
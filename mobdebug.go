@@ -0,0 +1,408 @@
+package lua_debugger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"github.com/yuin/gopher-lua/parse"
+	"log"
+	"math"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MobdebugDefaultPort is the port ZeroBrane Studio listens on
+const MobdebugDefaultPort = 8172
+
+// MobdebugTransport is a Transport speaking the MobDebug text protocol of
+// ZeroBrane Studio. Like mobdebug.start(), it connects to the IDE, and the
+// commands of the IDE are turned into the emmy messages for the Facade
+type MobdebugTransport struct {
+	emmyAdapter
+
+	c      net.Conn
+	closed int32
+
+	// guards the writes and everything below
+	m       sync.Mutex
+	ready   bool
+	baseDir string
+	output  bool
+	stacks  []proto.Stack
+	evalSeq int
+	pending map[int]bool
+}
+
+func NewMobdebugTransport() *MobdebugTransport {
+	return &MobdebugTransport{pending: make(map[int]bool)}
+}
+
+// Connect connects to ZeroBrane Studio on host:port, the debugging starts
+// with the first RUN or STEP of the IDE
+func (t *MobdebugTransport) Connect(host string, port int) error {
+	c, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	t.c = c
+	go t.serve()
+	return nil
+}
+
+func (t *MobdebugTransport) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	if t.c != nil {
+		return t.c.Close()
+	}
+	return nil
+}
+
+func (t *MobdebugTransport) isClosed() bool {
+	return atomic.LoadInt32(&t.closed) != 0
+}
+
+func (t *MobdebugTransport) serve() {
+	t.emmy(proto.MsgIdInitReq, &proto.InitReq{Ext: []string{".lua"}})
+
+	r := bufio.NewReader(t.c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		t.handleCommand(strings.TrimRight(line, "\r\n"))
+	}
+
+	_ = t.c.Close()
+	if !t.isClosed() {
+		t.request(proto.MsgIdActionReq, &proto.ActionReq{Action: proto.Stop}, proto.MsgIdActionRsp, nil)
+	}
+}
+
+// replyAnswer replies 200 OK or 400 Bad Request with the answer
+func (t *MobdebugTransport) replyAnswer(success bool, err string) {
+	if success {
+		t.reply("200 OK\n")
+	} else {
+		log.Println("mobdebug command fail:", err)
+		t.reply("400 Bad Request\n")
+	}
+}
+
+func (t *MobdebugTransport) reply(format string, args ...interface{}) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if _, err := fmt.Fprintf(t.c, format, args...); err != nil && !t.isClosed() {
+		log.Println("send mobdebug reply fail:", err)
+	}
+}
+
+func (t *MobdebugTransport) handleCommand(line string) {
+	command, args := line, ""
+	if i := strings.Index(line, " "); i >= 0 {
+		command, args = line[:i], strings.TrimSpace(line[i+1:])
+	}
+
+	switch command {
+	case "SETB", "DELB":
+		file, lineNo, ok := parseMobdebugBreakpoint(args)
+		if !ok {
+			t.reply("400 Bad Request\n")
+			return
+		}
+		if command == "DELB" && file == "*" {
+			t.request(proto.MsgIdAddBreakPointReq, &proto.AddBreakPointReq{Clear: true},
+				proto.MsgIdAddBreakPointRsp, t.replyAnswer)
+		} else if command == "SETB" {
+			bp := proto.BreakPoint{File: t.absPath(file), Line: lineNo}
+			t.request(proto.MsgIdAddBreakPointReq, &proto.AddBreakPointReq{BreakPoints: []proto.BreakPoint{bp}},
+				proto.MsgIdAddBreakPointRsp, t.replyAnswer)
+		} else {
+			// like mobdebug, removing a breakpoint which doesn't exist is fine
+			bp := proto.BreakPoint{File: t.absPath(file), Line: lineNo}
+			t.emmy(proto.MsgIdRemoveBreakPointReq, &proto.RemoveBreakPointReq{BreakPoints: []proto.BreakPoint{bp}})
+			t.reply("200 OK\n")
+		}
+	case "RUN":
+		t.run(proto.Continue)
+	case "STEP":
+		t.run(proto.StepIn)
+	case "OVER":
+		t.run(proto.StepOver)
+	case "OUT":
+		t.run(proto.StepOut)
+	case "SUSPEND":
+		// replied with 202 Paused at the break
+		t.request(proto.MsgIdActionReq, &proto.ActionReq{Action: proto.Break}, proto.MsgIdActionRsp, nil)
+	case "EXEC":
+		t.exec(args)
+	case "STACK":
+		t.m.Lock()
+		stack := serializeMobdebugStack(t.stacks, t.baseDir)
+		t.m.Unlock()
+		t.reply("200 OK %s\n", stack)
+	case "BASEDIR":
+		t.m.Lock()
+		t.baseDir = args
+		t.m.Unlock()
+		t.reply("200 OK\n")
+	case "OUTPUT":
+		// "OUTPUT stdout c|r|d", the output is sent with 204 Output unless
+		// it's disabled, the state needs captureOutput for it
+		fields := strings.Fields(args)
+		if len(fields) != 2 || fields[0] != "stdout" {
+			t.reply("400 Bad Request\n")
+			return
+		}
+		t.m.Lock()
+		t.output = fields[1] != "d"
+		t.m.Unlock()
+		t.reply("200 OK\n")
+	case "EXIT", "DONE":
+		t.reply("200 OK\n")
+		t.request(proto.MsgIdActionReq, &proto.ActionReq{Action: proto.Stop}, proto.MsgIdActionRsp, nil)
+	default:
+		t.reply("400 Bad Request\n")
+	}
+}
+
+// run starts or resumes the state, the first step breaks at the first line.
+// The 202 Paused of a break right after it follows the reply
+func (t *MobdebugTransport) run(action proto.DebugAction) {
+	t.m.Lock()
+	ready := t.ready
+	t.ready = true
+	stacks := t.stacks
+	t.stacks = nil
+	t.m.Unlock()
+
+	if ready {
+		t.request(proto.MsgIdActionReq, &proto.ActionReq{Action: action}, proto.MsgIdActionRsp, func(success bool, err string) {
+			if !success {
+				// still paused where it was
+				t.m.Lock()
+				if t.stacks == nil {
+					t.stacks = stacks
+				}
+				t.m.Unlock()
+			}
+			t.replyAnswer(success, err)
+		})
+		return
+	}
+	t.reply("200 OK\n")
+	if action != proto.Continue {
+		t.request(proto.MsgIdActionReq, &proto.ActionReq{Action: proto.Break}, proto.MsgIdActionRsp, nil)
+	}
+	t.emmy(proto.MsgIdReadyReq, &proto.ReadyReq{})
+}
+
+// exec evaluates the chunk at the top lua frame, it's usually
+// "return <expr>", optionally followed by " -- {params}". Only the
+// expressions are supported, the Facade evaluates them, so a statement like
+// "x = 5" fails
+func (t *MobdebugTransport) exec(chunk string) {
+	if i := strings.LastIndex(chunk, " -- {"); i >= 0 {
+		chunk = chunk[:i]
+	}
+	chunk = strings.TrimSpace(chunk)
+	if strings.HasPrefix(chunk, "return ") {
+		chunk = chunk[len("return "):]
+	}
+	if _, err := parse.Parse(strings.NewReader("return "+chunk), "exec"); err != nil {
+		msg := "not an expression: " + err.Error()
+		t.reply("401 Error in Execution %d\n%s", len(msg), msg)
+		return
+	}
+
+	t.m.Lock()
+	if t.stacks == nil {
+		t.m.Unlock()
+		msg := "not paused"
+		t.reply("401 Error in Execution %d\n%s", len(msg), msg)
+		return
+	}
+	level := 0
+	for _, stack := range t.stacks {
+		if stack.Line >= 0 {
+			level = stack.Level
+			break
+		}
+	}
+	t.evalSeq++
+	seq := t.evalSeq
+	t.pending[seq] = true
+	t.m.Unlock()
+
+	t.emmy(proto.MsgIdEvalReq, &proto.EvalReq{Seq: seq, Expr: chunk, StackLevel: level, Depth: 1})
+}
+
+// Send handles the messages from the Facade
+func (t *MobdebugTransport) Send(cmd int, msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("send msg fail:", err)
+		return
+	}
+	typed := proto.GetMsg(cmd)
+	if typed == nil || json.Unmarshal(data, typed) != nil {
+		return
+	}
+
+	switch m := typed.(type) {
+	case *proto.AddBreakPointRsp:
+		t.answers.answer(cmd, m.Success, m.Error)
+	case *proto.ActionRsp:
+		t.answers.answer(cmd, m.Success, m.Error)
+	case *proto.BreakNotify:
+		t.answers.after(proto.MsgIdActionRsp, func() {
+			t.m.Lock()
+			t.stacks = m.Stacks
+			baseDir := t.baseDir
+			t.m.Unlock()
+			for _, stack := range m.Stacks {
+				if stack.Line >= 0 {
+					t.reply("202 Paused %s %d\n", relPath(baseDir, stack.File), stack.Line)
+					return
+				}
+			}
+		})
+	case *proto.EvalRsp:
+		t.m.Lock()
+		ok := t.pending[m.Seq]
+		delete(t.pending, m.Seq)
+		t.m.Unlock()
+		if !ok {
+			return
+		}
+		if !m.Success || m.Value == nil {
+			t.reply("401 Error in Expression %d\n%s", len(m.Error), m.Error)
+			return
+		}
+		res := "do local _={" + mobdebugValue(m.Value) + "};return _;end"
+		t.reply("200 OK %d\n%s", len(res), res)
+	case *proto.LogNotify:
+		t.m.Lock()
+		output := t.output
+		t.m.Unlock()
+		if output && m.Output {
+			t.reply("204 Output stdout %d\n%s", len(m.Message), m.Message)
+		}
+	}
+}
+
+func (t *MobdebugTransport) absPath(file string) string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.baseDir == "" || filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(t.baseDir, file)
+}
+
+func relPath(baseDir, file string) string {
+	if baseDir != "" {
+		if rel, err := filepath.Rel(baseDir, file); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return file
+}
+
+// parseMobdebugBreakpoint parses "<file> <line>", the file may have spaces
+func parseMobdebugBreakpoint(args string) (string, int, bool) {
+	i := strings.LastIndex(args, " ")
+	if i < 0 {
+		return "", 0, false
+	}
+	line, err := strconv.Atoi(args[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return args[:i], line, true
+}
+
+// mobdebugValue returns v as a lua literal, a table with its fields
+func mobdebugValue(v *proto.Variable) string {
+	switch v.ValueType {
+	case LUA_TNIL, LUA_TBOOLEAN:
+		return v.Value
+	case LUA_TNUMBER:
+		// lua has no literal for them
+		if n, err := strconv.ParseFloat(v.Value, 64); err == nil {
+			switch {
+			case math.IsInf(n, 1):
+				return "1/0"
+			case math.IsInf(n, -1):
+				return "-1/0"
+			case math.IsNaN(n):
+				return "0/0"
+			}
+		}
+		return v.Value
+	case LUA_TSTRING:
+		return luaQuote(v.Value)
+	case LUA_TTABLE:
+		var fields []string
+		for _, child := range v.Children {
+			key := luaQuote(child.Name)
+			if child.NameType == LUA_TNUMBER || child.NameType == LUA_TBOOLEAN {
+				key = child.Name
+			}
+			fields = append(fields, "["+key+"]="+mobdebugValue(child))
+		}
+		return "{" + strings.Join(fields, ",") + "}"
+	}
+	return luaQuote(v.ValueTypeName + ": " + v.Value)
+}
+
+// luaQuote returns s as a lua string literal like string.format("%q"), the
+// control characters are written as decimal escapes, which lua understands
+// unlike the hex ones of strconv.Quote
+func luaQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString("\\n")
+		case c < 0x20 || c == 0x7f:
+			// 3 digits, a digit may follow
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// serializeMobdebugStack serializes the lua frames like mobdebug does, each
+// one is {{name, source, linedefined, currentline, what, namewhat,
+// short_src}, locals, upvalues}, a variable is {value, tostring(value)}
+func serializeMobdebugStack(stacks []proto.Stack, baseDir string) string {
+	var frames []string
+	for _, stack := range stacks {
+		if stack.Line < 0 {
+			continue
+		}
+		file := luaQuote(relPath(baseDir, stack.File))
+		info := fmt.Sprintf("{%s,%s,0,%d,\"Lua\",\"\",%s}", luaQuote(stack.FunctionName), file, stack.Line, file)
+
+		var locals []string
+		for _, v := range stack.LocalVariables {
+			value := mobdebugValue(v)
+			locals = append(locals, fmt.Sprintf("[%s]={%s,%s}", luaQuote(v.Name), value, luaQuote(v.Value)))
+		}
+		frames = append(frames, "{"+info+",{"+strings.Join(locals, ",")+"},{}}")
+	}
+	return "do local _={" + strings.Join(frames, ",") + "};return _;end"
+}
@@ -0,0 +1,122 @@
+package lua_debugger
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	lua "github.com/yuin/gopher-lua"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMobdebugTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		fcd := registerFacade(L)
+		if err := fcd.MobdebugConnect(L, "127.0.0.1", port, nil); err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+	done := make(chan error, 1)
+	go func() {
+		fn, err := L.Load(strings.NewReader(testScript), "test.lua")
+		if err == nil {
+			L.Push(fn)
+			err = L.PCall(0, 0, nil)
+		}
+		done <- err
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+	command := func(cmd, expect string) string {
+		if cmd != "" {
+			_, _ = fmt.Fprintf(c, "%s\n", cmd)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, expect) {
+			t.Fatalf("%s: expect %q, got %q", cmd, expect, line)
+		}
+		return strings.TrimSpace(line[len(expect):])
+	}
+
+	command("SETB test.lua 3", "200 OK")
+	command("SETB test.lua 0", "400 Bad Request")
+	command("RUN", "200 OK")
+	command("", "202 Paused test.lua 3")
+
+	var size int
+	_, _ = fmt.Sscan(command("EXEC return a + 1", "200 OK"), &size)
+	res := make([]byte, size)
+	if _, err := io.ReadFull(r, res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != "do local _={2};return _;end" {
+		t.Fatal("unexpected exec result", string(res))
+	}
+	// only the expressions are evaluated
+	_, _ = fmt.Sscan(command("EXEC x = 5", "401 Error in Execution"), &size)
+	if _, err := io.ReadFull(r, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if stack := command("STACK", "200 OK"); !strings.Contains(stack, `["a"]={1,"1"}`) {
+		t.Fatal("unexpected stack", stack)
+	}
+	command("OVER", "200 OK")
+	command("", "202 Paused test.lua 4")
+
+	command("DELB * 0", "200 OK")
+	command("RUN", "200 OK")
+	expectScriptDone(t, L, done)
+}
+
+func TestLuaQuote(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	for _, s := range []string{"", "plain", "a\"b\\c", "line\nbreak\r\t", "\x00" + "1\x1f\x7f", "\xff\xfe"} {
+		if err := L.DoString("s = " + luaQuote(s)); err != nil {
+			t.Fatal(err)
+		}
+		if got := L.GetGlobal("s").String(); got != s {
+			t.Fatalf("%q quoted as %s, read back as %q", s, luaQuote(s), got)
+		}
+	}
+}
+
+func TestMobdebugValue(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	for _, n := range []float64{math.Inf(1), math.Inf(-1), math.NaN(), 1.5} {
+		num := &proto.Variable{ValueType: LUA_TNUMBER, Value: lua.LNumber(n).String()}
+		table := &proto.Variable{ValueType: LUA_TTABLE, Children: []*proto.Variable{
+			{Name: "n", NameType: LUA_TSTRING, ValueType: LUA_TNUMBER, Value: num.Value},
+		}}
+		if err := L.DoString("x = " + mobdebugValue(num) + "; t = " + mobdebugValue(table)); err != nil {
+			t.Fatal(num.Value, err)
+		}
+		x := float64(L.GetGlobal("x").(lua.LNumber))
+		y := float64(L.GetField(L.GetGlobal("t"), "n").(lua.LNumber))
+		if math.IsNaN(n) != math.IsNaN(x) || !math.IsNaN(n) && (x != n || y != n) {
+			t.Fatalf("%s serialized as %s", num.Value, mobdebugValue(num))
+		}
+	}
+}
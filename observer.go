@@ -0,0 +1,166 @@
+package lua_debugger
+
+import (
+	"crypto/tls"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"log"
+	"net"
+)
+
+// observer is a read-only client of a session, it gets the notifications
+// like the IDE but can't change the state of the debugger. caps and
+// authenticated are guarded by the mutexObservers of fcd
+type observer struct {
+	fcd           *Facade
+	t             *Compressor
+	caps          map[string]struct{}
+	authenticated bool
+}
+
+func (o *observer) supports(capability string) bool {
+	o.fcd.mutexObservers.Lock()
+	defer o.fcd.mutexObservers.Unlock()
+	_, ok := o.caps[capability]
+	return ok
+}
+
+// reject tells the observer its message is dropped, if it knows ErrorNotify
+func (o *observer) reject(notify *proto.ErrorNotify) {
+	if o.supports(proto.CapErrorNotify) {
+		o.t.Send(proto.MsgIdErrorNotify, notify)
+	} else {
+		log.Println("drop msg of observer:", notify.Cmd, notify.Error)
+	}
+}
+
+// AddObserver lets the client at the other end of t watch the session, it
+// can ask for the stacks but not step, eval or set breakpoints
+func (f *Facade) AddObserver(t Transport) {
+	o := &observer{fcd: f, t: NewCompressor(t)}
+	o.t.SetHandler(func(cmd int, req interface{}) {
+		f.handleObserverMsg(o, cmd, req)
+	})
+
+	f.mutexObservers.Lock()
+	f.observers[o] = struct{}{}
+	f.mutexObservers.Unlock()
+}
+
+func (f *Facade) removeObserver(o *observer) {
+	f.mutexObservers.Lock()
+	delete(f.observers, o)
+	f.mutexObservers.Unlock()
+	_ = o.t.Close()
+}
+
+// ListenObservers accepts the observers on addr, until f is closed
+func (f *Facade) ListenObservers(addr string, tlsConfig *tls.Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	f.observerListener = l
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if !f.isClosed() {
+					log.Println("accept observer fail:", err)
+				}
+				return
+			}
+			t := &NetTransport{requestsOnly: true}
+			f.AddObserver(t)
+			t.ServeConn(c)
+		}
+	}()
+	return nil
+}
+
+func (f *Facade) closeObservers() {
+	if f.observerListener != nil {
+		_ = f.observerListener.Close()
+	}
+
+	f.mutexObservers.Lock()
+	observers := f.observers
+	f.observers = make(map[*observer]struct{})
+	f.mutexObservers.Unlock()
+	for o := range observers {
+		_ = o.t.Close()
+	}
+}
+
+// notifyObservers sends the notification to every observer, msg returns it
+// for the capabilities of the observer
+func (f *Facade) notifyObservers(cmd int, msg func(o *observer) interface{}) {
+	var observers []*observer
+	f.mutexObservers.Lock()
+	for o := range f.observers {
+		if o.authenticated || f.secret == "" {
+			observers = append(observers, o)
+		}
+	}
+	f.mutexObservers.Unlock()
+
+	for _, o := range observers {
+		o.t.Send(cmd, msg(o))
+	}
+}
+
+func (f *Facade) handleObserverMsg(o *observer, cmd int, req interface{}) {
+	if f.isClosed() {
+		return
+	}
+	if f.secret != "" && !o.authenticated && cmd >= 0 {
+		if cmd == proto.MsgIdAuthReq {
+			rsp := f.checkSecret(req.(*proto.AuthReq))
+			f.mutexObservers.Lock()
+			o.authenticated = rsp.Success
+			f.mutexObservers.Unlock()
+			o.t.Send(proto.MsgIdAuthRsp, rsp)
+			if !rsp.Success {
+				f.removeObserver(o)
+			}
+		} else {
+			log.Println("ignore msg before authenticated:", cmd)
+		}
+		return
+	}
+
+	switch cmd {
+	case proto.MsgIdInitReq:
+		caps := make(map[string]struct{})
+		for _, capability := range req.(*proto.InitReq).Capabilities {
+			caps[capability] = struct{}{}
+		}
+		f.mutexObservers.Lock()
+		o.caps = caps
+		f.mutexObservers.Unlock()
+		o.t.Send(proto.MsgIdInitRsp, proto.InitRsp{
+			Version:      proto.Version,
+			Capabilities: capabilities,
+		})
+		o.t.SetEnabled(o.supports(proto.CapCompress))
+	case proto.MsgIdReadyReq:
+	case proto.MsgIdStackReq:
+		o.t.Send(proto.MsgIdStackRsp, f.stackRsp(req.(*proto.StackReq)))
+	case proto.MsgIdActionReq:
+		// the observer leaves, or its connection is lost
+		if req.(*proto.ActionReq).Action == proto.Stop {
+			f.removeObserver(o)
+			return
+		}
+		o.reject(&proto.ErrorNotify{Cmd: cmd, Error: "read-only observer"})
+	case MsgIdFrameError:
+		o.reject(req.(*proto.ErrorNotify))
+	default:
+		if cmd >= 0 {
+			o.reject(&proto.ErrorNotify{Cmd: cmd, Error: "read-only observer"})
+		}
+	}
+}
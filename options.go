@@ -0,0 +1,198 @@
+package lua_debugger
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	lua "github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"time"
+)
+
+// Options configures the connection to the IDE, it's the optional last
+// argument of the connect and listen functions of emmy_core:
+//
+//	dbg.tcpConnect('localhost', 9966, {
+//	    reconnect = { retries = 0, minBackoff = 1000, maxBackoff = 30000 }, -- or true for the defaults
+//	    tls = { cert = 'cert.pem', key = 'key.pem', ca = 'ca.pem', serverName = 'debugger' },
+//	    secret = 'shared secret',
+//	    record = 'session.jsonl',
+//	    dialTimeout = 3000, retries = 3, retryInterval = 1000,
+//	    writeTimeout = 3000, -- drop the connection if a message can't be written in time
+//	    maxFrameSize = 4194304, -- in bytes, larger messages from the IDE are dropped
+//	    origins = { 'https://ide.example.com' }, -- web pages allowed by wsListen besides localhost
+//	    origin = 'https://ide.example.com', -- the Origin sent by wsConnect
+//	    observers = '0.0.0.0:9967', -- read-only clients watching the session connect here
+//	    waitTimeout = 5000, -- give up if the IDE is not ready in time
+//	    block = false, -- don't wait for the IDE, it's attached whenever it comes
+//	    pause = true, -- break at the first line once the IDE is ready
+//	})
+//
+// all durations are in milliseconds. With ca set, the peer's certificate is
+// verified by it, both as a client and as a server
+type Options struct {
+	DialTimeout time.Duration
+	// DialRetries is the number of retries after the first connect or listen
+	// attempt fails
+	DialRetries   int
+	RetryInterval time.Duration
+	// WaitTimeout is the max time to wait for the IDE to be ready, 0 means
+	// forever
+	WaitTimeout time.Duration
+	// NonBlocking returns right after connected, without waiting for the IDE
+	NonBlocking bool
+	// PauseOnEntry breaks at the first line run after the IDE is ready
+	PauseOnEntry bool
+	// WriteTimeout limits the time to write a message to the IDE, see
+	// NetTransport.WriteTimeout
+	WriteTimeout time.Duration
+	// MaxFrameSize limits the size of a message from the IDE, see
+	// NetTransport.MaxFrameSize
+	MaxFrameSize int
+	// WsOrigins and WsOrigin are for the websocket, see NetTransport
+	WsOrigins []string
+	WsOrigin  string
+	// ObserverAddr is the host:port to accept the read-only observers on,
+	// they get the notifications but can't control the debugger
+	ObserverAddr string
+	// ControlAddr is the host:port, or "unix:" and a socket path, to serve
+	// the http control API on, see Facade.ListenControl
+	ControlAddr string
+	// CaptureOutput sends the output of print and io.write to the IDE as
+	// LogNotify, the output still goes to stdout
+	CaptureOutput bool
+
+	Reconnect *ReconnectPolicy
+	TLSConfig *tls.Config
+	// Secret must be sent by the IDE in AuthReq before any other message
+	Secret string
+	// RecordFile records the session into the file, see Recorder
+	RecordFile string
+}
+
+func checkOptions(L *lua.LState, n int) *Options {
+	opts := &Options{RetryInterval: time.Second}
+	tb := L.OptTable(n, nil)
+	if tb == nil {
+		return opts
+	}
+
+	opts.DialTimeout = optDuration(tb, "dialTimeout", opts.DialTimeout)
+	opts.DialRetries = optInt(tb, "retries", opts.DialRetries)
+	opts.RetryInterval = optDuration(tb, "retryInterval", opts.RetryInterval)
+	opts.WaitTimeout = optDuration(tb, "waitTimeout", opts.WaitTimeout)
+	opts.WriteTimeout = optDuration(tb, "writeTimeout", opts.WriteTimeout)
+	opts.MaxFrameSize = optInt(tb, "maxFrameSize", opts.MaxFrameSize)
+	if block, ok := tb.RawGetString("block").(lua.LBool); ok {
+		opts.NonBlocking = !bool(block)
+	}
+	opts.PauseOnEntry = lua.LVAsBool(tb.RawGetString("pause"))
+	opts.CaptureOutput = lua.LVAsBool(tb.RawGetString("captureOutput"))
+
+	if secret, ok := tb.RawGetString("secret").(lua.LString); ok {
+		opts.Secret = string(secret)
+	}
+	if record, ok := tb.RawGetString("record").(lua.LString); ok {
+		opts.RecordFile = string(record)
+	}
+	opts.ObserverAddr = optString(tb, "observers")
+	opts.ControlAddr = optString(tb, "control")
+	opts.WsOrigin = optString(tb, "origin")
+	if origins, ok := tb.RawGetString("origins").(*lua.LTable); ok {
+		origins.ForEach(func(_, origin lua.LValue) {
+			opts.WsOrigins = append(opts.WsOrigins, origin.String())
+		})
+	}
+	if tlsTb, ok := tb.RawGetString("tls").(*lua.LTable); ok {
+		config, err := LoadTLSConfig(
+			optString(tlsTb, "cert"),
+			optString(tlsTb, "key"),
+			optString(tlsTb, "ca"),
+		)
+		if err != nil {
+			L.ArgError(n, err.Error())
+		}
+		config.ServerName = optString(tlsTb, "serverName")
+		opts.TLSConfig = config
+	}
+
+	switch reconnect := tb.RawGetString("reconnect").(type) {
+	case lua.LBool:
+		if reconnect {
+			opts.Reconnect = DefaultReconnectPolicy()
+		}
+	case *lua.LTable:
+		opts.Reconnect = DefaultReconnectPolicy()
+		opts.Reconnect.MaxRetries = optInt(reconnect, "retries", opts.Reconnect.MaxRetries)
+		opts.Reconnect.MinBackoff = optDuration(reconnect, "minBackoff", opts.Reconnect.MinBackoff)
+		opts.Reconnect.MaxBackoff = optDuration(reconnect, "maxBackoff", opts.Reconnect.MaxBackoff)
+	}
+	return opts
+}
+
+func (opts *Options) newNetTransport() *NetTransport {
+	if opts == nil {
+		return &NetTransport{requestsOnly: true}
+	}
+	return &NetTransport{
+		requestsOnly: true,
+		Reconnect:    opts.Reconnect,
+		TLSConfig:    opts.TLSConfig,
+		DialTimeout:  opts.DialTimeout,
+		WriteTimeout: opts.WriteTimeout,
+		MaxFrameSize: opts.MaxFrameSize,
+		WsOrigins:    opts.WsOrigins,
+		WsOrigin:     opts.WsOrigin,
+	}
+}
+
+// LoadTLSConfig loads the pem files into a config usable by both sides of a
+// connection, e.g. for NetTransport.TLSConfig. Every argument is optional but
+// a server needs its certificate, with caFile the peer must have a
+// certificate signed by it
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func optString(tb *lua.LTable, key string) string {
+	if v, ok := tb.RawGetString(key).(lua.LString); ok {
+		return string(v)
+	}
+	return ""
+}
+
+func optInt(tb *lua.LTable, key string, def int) int {
+	if v, ok := tb.RawGetString(key).(lua.LNumber); ok {
+		return int(v)
+	}
+	return def
+}
+
+func optDuration(tb *lua.LTable, key string, def time.Duration) time.Duration {
+	if v, ok := tb.RawGetString(key).(lua.LNumber); ok {
+		return time.Duration(v) * time.Millisecond
+	}
+	return def
+}
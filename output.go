@@ -0,0 +1,110 @@
+package lua_debugger
+
+import (
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	lua "github.com/yuin/gopher-lua"
+	"strings"
+)
+
+// capturedOutput keeps the print and io.write replaced in a state
+type capturedOutput struct {
+	print, write         lua.LValue
+	wrapPrint, wrapWrite *lua.LFunction
+}
+
+// sendLog sends notify to the IDE and the observers which are authenticated,
+// the output and the diagnostics may show the values of the script
+func (f *Facade) sendLog(notify *proto.LogNotify) {
+	if f.isClosed() || f.t == nil {
+		return
+	}
+	if f.isAuthenticated() {
+		f.t.Send(proto.MsgIdLogNotify, notify)
+	}
+	f.notifyObservers(proto.MsgIdLogNotify, func(o *observer) interface{} {
+		return notify
+	})
+}
+
+// sendOutput sends the output of L with the location of the lua code
+// calling print or io.write
+func (f *Facade) sendOutput(L *lua.LState, text string) {
+	notify := &proto.LogNotify{Type: proto.LogInfo, Message: text, Output: true}
+	// level 0 is the wrapper
+	if ar, ok := L.GetStack(1); ok {
+		if _, err := L.GetInfo("Sl", ar, nil); err == nil {
+			notify.File = f.dbg.GetFile(L, &Ar{Debug: *ar})
+			notify.Line = ar.CurrentLine
+		}
+	}
+	f.sendLog(notify)
+}
+
+// captureOutput wraps print and io.write of L, the output goes on as before
+// and is sent to the IDE too. It must be called on the goroutine running L
+func (f *Facade) captureOutput(L *lua.LState) {
+	f.mutexStates.Lock()
+	defer f.mutexStates.Unlock()
+	if _, ok := f.outputs[L]; ok {
+		return
+	}
+
+	c := &capturedOutput{print: L.GetGlobal("print")}
+	c.wrapPrint = L.NewFunction(func(L *lua.LState) int {
+		n := L.GetTop()
+		parts := make([]string, 0, n)
+		for i := 1; i <= n; i++ {
+			parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+		}
+		f.sendOutput(L, strings.Join(parts, "\t")+"\n")
+		return callOriginal(L, c.print)
+	})
+	L.SetGlobal("print", c.wrapPrint)
+
+	if io, ok := L.GetGlobal("io").(*lua.LTable); ok {
+		c.write = io.RawGetString("write")
+		c.wrapWrite = L.NewFunction(func(L *lua.LState) int {
+			var sb strings.Builder
+			for i := 1; i <= L.GetTop(); i++ {
+				if v := L.Get(i); v.Type() == lua.LTString || v.Type() == lua.LTNumber {
+					sb.WriteString(v.String())
+				}
+			}
+			f.sendOutput(L, sb.String())
+			return callOriginal(L, c.write)
+		})
+		io.RawSetString("write", c.wrapWrite)
+	}
+	f.outputs[L] = c
+}
+
+// restoreOutput puts back print and io.write of L, unless the script has
+// replaced them. It must be called on the goroutine running L
+func (f *Facade) restoreOutput(L *lua.LState) {
+	f.mutexStates.Lock()
+	c, ok := f.outputs[L]
+	delete(f.outputs, L)
+	f.mutexStates.Unlock()
+	if !ok {
+		return
+	}
+
+	if L.GetGlobal("print") == c.wrapPrint {
+		L.SetGlobal("print", c.print)
+	}
+	if io, ok := L.GetGlobal("io").(*lua.LTable); ok && c.wrapWrite != nil && io.RawGetString("write") == c.wrapWrite {
+		io.RawSetString("write", c.write)
+	}
+}
+
+// callOriginal calls fn with the arguments of the running go function, and
+// returns the number of the results
+func callOriginal(L *lua.LState, fn lua.LValue) int {
+	n := L.GetTop()
+	L.Push(fn)
+	for i := 1; i <= n; i++ {
+		L.Push(L.Get(i))
+	}
+	L.Call(n, lua.MultRet)
+	return L.GetTop() - n
+}
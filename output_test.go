@@ -0,0 +1,92 @@
+package lua_debugger
+
+import (
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	lua "github.com/yuin/gopher-lua"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFacade_SendLogSecret(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+
+	f := newFacade()
+	f.secret = "s3cret"
+	f.t = dbgSide
+	f.sendLog(&proto.LogNotify{Message: "before authenticated"})
+	f.setAuthenticated(true)
+	f.sendLog(&proto.LogNotify{Message: "after authenticated"})
+
+	if notify := ide.expect(&proto.LogNotify{}).(*proto.LogNotify); notify.Message != "after authenticated" {
+		t.Fatal("log sent before authenticated", notify.Message)
+	}
+}
+
+func TestFacade_CaptureOutput(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	ide.start(nil, proto.BreakPoint{File: "test.lua", Line: 3}, proto.BreakPoint{File: "test.lua", Line: 5})
+
+	L := lua.NewState()
+	defer L.Close()
+	print := L.GetGlobal("print")
+	L.SetGlobal("connect", L.NewFunction(func(L *lua.LState) int {
+		if err := Connect(L, dbgSide, &Options{CaptureOutput: true}); err != nil {
+			t.Error(err)
+		}
+		return 0
+	}))
+	L.SetGlobal("detach", L.NewFunction(func(L *lua.LState) int {
+		Detach(L)
+		return 0
+	}))
+	done := make(chan error, 1)
+	go func() {
+		fn, err := L.Load(strings.NewReader(`connect()
+local a = 1
+print("a is", a)
+io.write("b", 2, "\n")
+detach()`), "test.lua")
+		if err == nil {
+			L.Push(fn)
+			err = L.PCall(0, 0, nil)
+		}
+		done <- err
+	}()
+
+	ide.expectStarted()
+	ide.expectBreak()
+	// the debugger logs the failure of the eval
+	ide.Send(proto.MsgIdEvalReq, proto.EvalReq{Seq: 1, Expr: "nil + 1", StackLevel: 1})
+	if notify := ide.expect(&proto.LogNotify{}).(*proto.LogNotify); notify.Output || notify.Type != proto.LogWarning {
+		t.Fatal("unexpected log notify", notify)
+	}
+	if rsp := ide.expect(&proto.EvalRsp{}).(*proto.EvalRsp); rsp.Success {
+		t.Fatal("unexpected eval rsp", rsp)
+	}
+
+	ide.action(proto.Continue)
+	for _, expect := range []proto.LogNotify{
+		{Message: "a is\t1\n", Output: true, File: "test.lua", Line: 3},
+		{Message: "b2\n", Output: true, File: "test.lua", Line: 4},
+	} {
+		if notify := ide.expect(&proto.LogNotify{}).(*proto.LogNotify); *notify != expect {
+			t.Fatal("unexpected output", *notify)
+		}
+	}
+	// stop before detach, which closes the transport with the output unread
+	ide.expectBreak()
+	ide.Send(proto.MsgIdActionReq, proto.ActionReq{Action: proto.Continue})
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lua not continued")
+	}
+	if L.GetGlobal("print") != print {
+		t.Fatal("print not restored")
+	}
+}
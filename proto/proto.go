@@ -32,6 +32,34 @@ const (
 
 	// debugger -> ide
 	MsgIdLogNotify
+
+	// extensions, not supported by the EmmyLua IDE
+	MsgIdAuthReq
+	MsgIdAuthRsp
+	MsgIdErrorNotify
+	MsgIdCompressed
+	MsgIdStackReq
+	MsgIdStackRsp
+)
+
+// Version is the version of the protocol sent in InitRsp
+const Version = "1.1"
+
+// the capabilities exchanged in InitReq and InitRsp, older EmmyLua clients
+// send none, so a feature beyond the EmmyLua protocol is only used when both
+// sides have it
+const (
+	CapLineBreakpoint = "lineBreakpoint"
+	// BreakPoint.Condition is a lua expression evaluated in the frame
+	CapConditionBreakpoint = "conditionBreakpoint"
+	CapEval                = "eval"
+	CapAuth                = "auth"
+	CapErrorNotify         = "errorNotify"
+	// the large messages may be sent gzipped in Compressed
+	CapCompress = "gzip"
+	// BreakNotify only has the variables of the top frame without the table
+	// fields, the IDE asks for the others with StackReq and EvalReq
+	CapLazyVariables = "lazyVariables"
 )
 
 type Variable struct {
@@ -62,21 +90,35 @@ type BreakPoint struct {
 type InitReq struct {
 	EmmyHelper string   `json:"emmyHelper"`
 	Ext        []string `json:"ext"`
+	// the fields below are only sent by the clients which know the
+	// capabilities
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
 }
 
 type InitRsp struct {
-	Version string `json:"version"`
+	Version      string   `json:"version"`
+	Capabilities []string `json:"capabilities"`
 }
 
 type ReadyReq struct {
 }
 
+type ReadyRsp struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
+
 type AddBreakPointReq struct {
 	Clear       bool         `json:"clear"`
 	BreakPoints []BreakPoint `json:"breakPoints"`
 }
 
+// AddBreakPointRsp tells the invalid breakpoints in Error, the valid ones of
+// the request are added anyway
 type AddBreakPointRsp struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
 }
 
 type RemoveBreakPointReq struct {
@@ -84,6 +126,8 @@ type RemoveBreakPointReq struct {
 }
 
 type RemoveBreakPointRsp struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
 }
 
 type DebugAction int
@@ -102,6 +146,8 @@ type ActionReq struct {
 }
 
 type ActionRsp struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
 }
 
 type BreakNotify struct {
@@ -124,6 +170,36 @@ type EvalRsp struct {
 	Value   *Variable `json:"value"`
 }
 
+type LogType int
+
+const (
+	LogInfo LogType = iota
+	LogWarning
+	LogError
+)
+
+// LogNotify is a diagnostic of the debugger, or the output of print and
+// io.write when it's captured
+type LogNotify struct {
+	Type    LogType `json:"type"`
+	Message string  `json:"message"`
+	// the fields below are only set for the output of lua, with the file and
+	// line of the call
+	Output bool   `json:"output,omitempty"`
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line,omitempty"`
+}
+
+// AuthReq must be the first message when the debugger requires a secret
+type AuthReq struct {
+	Secret string `json:"secret"`
+}
+
+type AuthRsp struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
+
 var msgIdToReqMap = map[int]reflect.Type{
 	MsgIdInitReq:             reflect.TypeOf(&InitReq{}),
 	MsgIdReadyReq:            reflect.TypeOf(&ReadyReq{}),
@@ -131,13 +207,72 @@ var msgIdToReqMap = map[int]reflect.Type{
 	MsgIdRemoveBreakPointReq: reflect.TypeOf(&RemoveBreakPointReq{}),
 	MsgIdActionReq:           reflect.TypeOf(&ActionReq{}),
 	MsgIdEvalReq:             reflect.TypeOf(&EvalReq{}),
+	MsgIdAuthReq:             reflect.TypeOf(&AuthReq{}),
+	MsgIdCompressed:          reflect.TypeOf(&Compressed{}),
+	MsgIdStackReq:            reflect.TypeOf(&StackReq{}),
 }
 
+// the messages sent by the debugger, used by the IDE side of a transport
+var msgIdToRspMap = map[int]reflect.Type{
+	MsgIdInitRsp:             reflect.TypeOf(&InitRsp{}),
+	MsgIdReadyRsq:            reflect.TypeOf(&ReadyRsp{}),
+	MsgIdAddBreakPointRsp:    reflect.TypeOf(&AddBreakPointRsp{}),
+	MsgIdRemoveBreakPointRsp: reflect.TypeOf(&RemoveBreakPointRsp{}),
+	MsgIdActionRsp:           reflect.TypeOf(&ActionRsp{}),
+	MsgIdEvalRsp:             reflect.TypeOf(&EvalRsp{}),
+	MsgIdBreakNotify:         reflect.TypeOf(&BreakNotify{}),
+	MsgIdLogNotify:           reflect.TypeOf(&LogNotify{}),
+	MsgIdAuthRsp:             reflect.TypeOf(&AuthRsp{}),
+	MsgIdErrorNotify:         reflect.TypeOf(&ErrorNotify{}),
+	MsgIdStackRsp:            reflect.TypeOf(&StackRsp{}),
+}
+
+// ErrorNotify tells the peer a message it sent can't be decoded, the message
+// is dropped and the session goes on
+type ErrorNotify struct {
+	Cmd   int    `json:"cmd"`
+	Error string `json:"error"`
+}
+
+// Compressed carries the gzipped json of the message with the id Cmd, it's
+// sent in both directions once the peer has CapCompress
+type Compressed struct {
+	Cmd  int    `json:"cmd"`
+	Data []byte `json:"data"`
+}
+
+// StackReq asks for the variables of the frame at Level of the state
+// blocked at a break
+type StackReq struct {
+	Seq   int `json:"seq"`
+	Level int `json:"level"`
+}
+
+type StackRsp struct {
+	Seq     int    `json:"seq"`
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+	Stack   *Stack `json:"stack"`
+}
+
+// GetMsg returns a new message of any side for msgId, nil if it's unknown
 func GetMsg(msgId int) interface{} {
 	t := msgIdToReqMap[msgId]
 	if t == nil {
-		return nil
+		t = msgIdToRspMap[msgId]
 	}
+	return newMsg(t)
+}
+
+// GetReq is GetMsg for the debugger side, it returns nil for the messages
+// only the debugger sends
+func GetReq(msgId int) interface{} {
+	return newMsg(msgIdToReqMap[msgId])
+}
 
+func newMsg(t reflect.Type) interface{} {
+	if t == nil {
+		return nil
+	}
 	return reflect.New(t.Elem()).Interface()
 }
@@ -0,0 +1,184 @@
+package lua_debugger
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// RecordIn is the direction of the messages from the IDE
+	RecordIn = "in"
+	// RecordOut is the direction of the messages to the IDE
+	RecordOut = "out"
+	// RecordedSecret replaces the secret of AuthReq in the records, which
+	// are meant to be shared
+	RecordedSecret = "<redacted>"
+)
+
+// RecordEntry is a line of a recorded session
+type RecordEntry struct {
+	Time time.Time       `json:"time"`
+	Dir  string          `json:"dir"`
+	Cmd  int             `json:"cmd"`
+	Msg  json.RawMessage `json:"msg"`
+}
+
+// Recorder is a Transport which writes every message passing through t to w
+// as json lines, w is closed with the transport if it's an io.Closer
+type Recorder struct {
+	t Transport
+	w io.Writer
+	m sync.Mutex
+}
+
+func NewRecorder(t Transport, w io.Writer) *Recorder {
+	return &Recorder{t: t, w: w}
+}
+
+func (r *Recorder) Send(cmd int, msg interface{}) {
+	r.record(RecordOut, cmd, msg)
+	r.t.Send(cmd, msg)
+}
+
+func (r *Recorder) SetHandler(handler func(int, interface{})) {
+	r.t.SetHandler(func(cmd int, msg interface{}) {
+		r.record(RecordIn, cmd, msg)
+		handler(cmd, msg)
+	})
+}
+
+func (r *Recorder) Close() error {
+	err := r.t.Close()
+	if c, ok := r.w.(io.Closer); ok {
+		_ = c.Close()
+	}
+	return err
+}
+
+func (r *Recorder) record(dir string, cmd int, msg interface{}) {
+	// the local events like MsgIdDisconnected are not on the wire
+	if cmd < 0 {
+		return
+	}
+	if cmd == proto.MsgIdAuthReq {
+		msg = proto.AuthReq{Secret: RecordedSecret}
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("record msg fail:", err)
+		return
+	}
+	line, _ := json.Marshal(RecordEntry{Time: time.Now(), Dir: dir, Cmd: cmd, Msg: data})
+	line = append(line, '\n')
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if _, err := r.w.Write(line); err != nil {
+		log.Println("record msg fail:", err)
+	}
+}
+
+// Replay plays the IDE side of the session recorded in r through t, which is
+// usually the IDE end of a MemTransport pair. The messages from the IDE are
+// sent in order, and each one waits for the debugger messages recorded before
+// it. It returns the messages the debugger sent, and an error if they differ
+// from the recorded ones or don't arrive within timeout.
+//
+// A debugger message matches the recorded one if it has the same id and the
+// fields in the record, so the fields changing at every run like the table
+// addresses can be removed from the file, and {} matches any message. The
+// recorded secret is redacted, replay the sessions against a debugger without
+// one. The messages sent by the debugger after Replay returns are dropped
+func Replay(r io.Reader, t Transport, timeout time.Duration) ([]*RecordEntry, error) {
+	received := make(chan *RecordEntry, 1024)
+	done := make(chan struct{})
+	defer close(done)
+	t.SetHandler(func(cmd int, msg interface{}) {
+		if cmd < 0 {
+			return
+		}
+		data, _ := json.Marshal(msg)
+		select {
+		case received <- &RecordEntry{Time: time.Now(), Dir: RecordOut, Cmd: cmd, Msg: data}:
+		case <-done:
+		}
+	})
+
+	var result []*RecordEntry
+	dec := json.NewDecoder(r)
+	for {
+		var entry RecordEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			return result, nil
+		} else if err != nil {
+			return result, err
+		}
+
+		switch entry.Dir {
+		case RecordIn:
+			t.Send(entry.Cmd, entry.Msg)
+		case RecordOut:
+			select {
+			case got := <-received:
+				result = append(result, got)
+				if got.Cmd != entry.Cmd {
+					return result, fmt.Errorf("expect msg %d, got %d: %s", entry.Cmd, got.Cmd, got.Msg)
+				}
+				if !matchRecorded(entry.Msg, got.Msg) {
+					return result, fmt.Errorf("expect msg %d like %s, got %s", entry.Cmd, entry.Msg, got.Msg)
+				}
+			case <-time.After(timeout):
+				return result, fmt.Errorf("expect msg %d, got nothing", entry.Cmd)
+			}
+		default:
+			return result, fmt.Errorf("unknown direction: %s", entry.Dir)
+		}
+	}
+}
+
+// matchRecorded reports whether got has the fields of the recorded msg
+func matchRecorded(recorded, got json.RawMessage) bool {
+	var want, have interface{}
+	if err := json.Unmarshal(recorded, &want); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(got, &have); err != nil {
+		return false
+	}
+	return hasFields(want, have)
+}
+
+func hasFields(want, have interface{}) bool {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		have, ok := have.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range want {
+			if !hasFields(v, have[k]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		have, ok := have.([]interface{})
+		if !ok || len(have) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !hasFields(want[i], have[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(want, have)
+}
@@ -0,0 +1,97 @@
+package lua_debugger
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	lua "github.com/yuin/gopher-lua"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	ide, dbgSide := newMemTestIDE(t)
+	var buf bytes.Buffer
+	rec := NewRecorder(dbgSide, &buf)
+	dbg := newTestIDE(t, rec)
+
+	ide.Send(proto.MsgIdAuthReq, proto.AuthReq{Secret: "s3cret"})
+	dbg.expect(&proto.AuthReq{})
+	ide.Send(proto.MsgIdReadyReq, proto.ReadyReq{})
+	dbg.expect(&proto.ReadyReq{})
+	rec.Send(proto.MsgIdEvalRsp, proto.EvalRsp{Seq: 1})
+	ide.expect(&proto.EvalRsp{})
+
+	var entries []RecordEntry
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var entry RecordEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 ||
+		entries[0].Dir != RecordIn || entries[0].Cmd != proto.MsgIdAuthReq ||
+		entries[1].Dir != RecordIn || entries[1].Cmd != proto.MsgIdReadyReq ||
+		entries[2].Dir != RecordOut || entries[2].Cmd != proto.MsgIdEvalRsp {
+		t.Fatal("unexpected entries", entries)
+	}
+	if strings.Contains(buf.String(), "s3cret") {
+		t.Fatal("secret recorded", string(entries[0].Msg))
+	}
+}
+
+const testRecord = `{"dir":"in","cmd":1,"msg":{"emmyHelper":"","ext":[".lua"]}}
+{"dir":"out","cmd":2,"msg":{}}
+{"dir":"in","cmd":5,"msg":{"clear":true,"breakPoints":[{"file":"test.lua","line":3}]}}
+{"dir":"out","cmd":6,"msg":{}}
+{"dir":"in","cmd":3,"msg":{}}
+{"dir":"out","cmd":4,"msg":{}}
+{"dir":"out","cmd":13,"msg":{}}
+{"dir":"in","cmd":11,"msg":{"seq":1,"expr":"a + 1","stackLevel":1,"depth":1}}
+{"dir":"out","cmd":12,"msg":{"seq":1,"success":true,"value":{"value":"2"}}}
+{"dir":"in","cmd":9,"msg":{"action":1}}
+{"dir":"out","cmd":10,"msg":{}}
+`
+
+func TestReplay(t *testing.T) {
+	dbgSide, ideSide := NewMemTransportPair()
+	defer ideSide.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	done := runTestScript(t, L, dbgSide, nil)
+
+	received, err := Replay(strings.NewReader(testRecord), ideSide, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectScriptDone(t, L, done)
+
+	var rsp proto.EvalRsp
+	if err := json.Unmarshal(received[4].Msg, &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if !rsp.Success || rsp.Value.Value != "2" {
+		t.Fatal("unexpected eval rsp", string(received[4].Msg))
+	}
+}
+
+func TestReplay_Drift(t *testing.T) {
+	dbgSide, ideSide := NewMemTransportPair()
+	defer ideSide.Close()
+
+	L := lua.NewState()
+	defer L.Close()
+	done := runTestScript(t, L, dbgSide, nil)
+
+	// the debugger evaluates a + 1 to 2, not 3
+	drifted := strings.Replace(testRecord, `"value":"2"`, `"value":"3"`, 1)
+	if _, err := Replay(strings.NewReader(drifted), ideSide, 5*time.Second); err == nil || !strings.Contains(err.Error(), `"value":"3"`) {
+		t.Fatal("drift not found", err)
+	}
+	ideSide.Send(proto.MsgIdActionReq, proto.ActionReq{Action: proto.Continue})
+	expectScriptDone(t, L, done)
+}
@@ -3,86 +3,659 @@ package lua_debugger
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/edolphin-ydf/gopherlua-debugger/proto"
-	"io"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type Transport struct {
+// Transport carries the emmy messages between the debugger and the IDE
+type Transport interface {
+	// Send sends the message with the id cmd to the peer
+	Send(cmd int, msg interface{})
+	// SetHandler sets the callback for the messages received from the peer,
+	// it should be set before the peer starts to talk
+	SetHandler(handler func(int, interface{}))
+	Close() error
+}
+
+// MsgIdDisconnected is reported to the handler when the peer is lost and the
+// transport is trying to reconnect, it never goes on the wire
+const MsgIdDisconnected = -1
+
+// MsgIdSendFailed is reported to the handler with the error when a message
+// can't be written, the connection is closed then like it's broken
+const MsgIdSendFailed = -2
+
+// MsgIdFrameError is reported to the handler with a *proto.ErrorNotify when a
+// message from the peer is dropped, the handler may pass it on if the peer
+// has proto.CapErrorNotify
+const MsgIdFrameError = -3
+
+// DefaultQueueSize is the number of messages NetTransport.Send can queue
+// before it blocks
+const DefaultQueueSize = 64
+
+// DefaultWriteTimeout is the time NetTransport waits for the peer to read a
+// message before it drops the connection
+const DefaultWriteTimeout = 10 * time.Second
+
+// DefaultMaxFrameSize is the max size of a received message, the larger ones
+// are dropped
+const DefaultMaxFrameSize = 4 << 20
+
+// the time left to the queued messages when the transport is closed
+const closeFlushTimeout = time.Second
+
+// ReconnectPolicy tells NetTransport how to get the IDE back after the
+// connection is lost
+type ReconnectPolicy struct {
+	// MaxRetries is the max number of dial attempts, 0 means retry forever.
+	// A listening transport just waits for the IDE to connect again
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func DefaultReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{
+		MinBackoff: time.Second,
+		MaxBackoff: 30 * time.Second,
+	}
+}
+
+// NetTransport is the Transport over a tcp or unix domain socket connection
+type NetTransport struct {
+	// Reconnect enables reconnection after the connection is lost, the
+	// handler gets MsgIdDisconnected instead of a Stop action
+	Reconnect *ReconnectPolicy
+	// TLSConfig enables tls, the same config is used by Connect and Listen
+	TLSConfig *tls.Config
+	// DialTimeout limits the time of a connect, 0 means no limit
+	DialTimeout time.Duration
+	// WriteTimeout limits the time to write a message, DefaultWriteTimeout if
+	// 0, a negative one means no limit
+	WriteTimeout time.Duration
+	// QueueSize is the size of the outbound queue, DefaultQueueSize if 0
+	QueueSize int
+	// MaxFrameSize limits the size of a received message, a larger one is
+	// dropped with an ErrorNotify. DefaultMaxFrameSize if 0
+	MaxFrameSize int
+	// WsOrigins are the origins of the web pages allowed to connect to
+	// WsListen besides the loopback ones, e.g. https://ide.example.com, "*"
+	// allows any page
+	WsOrigins []string
+	// WsOrigin is the Origin sent by WsConnect, DefaultWsOrigin if empty
+	WsOrigin string
+
 	c       net.Conn
-	Handler func(int, interface{})
+	l       net.Listener
+	network string
+	address string
+	closed  int32
+	handler func(int, interface{})
+	// requestsOnly makes it the debugger end, see newMsg
+	requestsOnly bool
+
+	// the messages are written in order by a single goroutine
+	mutexConn sync.Mutex
+	initOnce  sync.Once
+	closeOnce sync.Once
+	out       chan []byte
+	done      chan struct{}
+	stopped   chan struct{}
+	// the connection a write failed on, its other messages are dropped
+	failed net.Conn
+}
+
+func (t *NetTransport) SetHandler(handler func(int, interface{})) {
+	t.handler = handler
+}
+
+func (t *NetTransport) Connect(host string, port int) error {
+	return t.dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// Listen starts listening on host:port and serves the first IDE that
+// connects, this is the "IDE as client" mode of EmmyLua
+func (t *NetTransport) Listen(host string, port int) error {
+	return t.listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// PipeConnect connects to the IDE through the unix domain socket at path
+func (t *NetTransport) PipeConnect(path string) error {
+	return t.dial("unix", path)
 }
 
-func (t *Transport) Connect(host string, port int) error {
+// PipeListen creates a unix domain socket at path which is only accessible
+// by the current user, and serves the first IDE that connects. A socket left
+// at path by a dead process is replaced
+func (t *NetTransport) PipeListen(path string) error {
+	return t.listen("unix", path)
+}
+
+// WsConnect connects to the websocket server at url, e.g. ws://host:port/path
+// or wss://... with TLSConfig, one message per frame
+func (t *NetTransport) WsConnect(url string) error {
+	return t.dial("ws", url)
+}
+
+// WsListen serves websocket on host:port for browser based frontends, the
+// IDE can connect to any path
+func (t *NetTransport) WsListen(host string, port int) error {
+	return t.listen("ws", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func (t *NetTransport) dial(network, address string) error {
+	t.init()
+	t.network = network
+	t.address = address
+	c, err := t.dialConn()
+	if err != nil {
+		return err
+	}
+	t.setConn(c)
+	go t.serve()
+
+	return nil
+}
+
+func (t *NetTransport) dialConn() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: t.DialTimeout}
+	if t.network == "ws" {
+		return dialWs(t.address, t.WsOrigin, dialer, t.TLSConfig)
+	}
+	if t.TLSConfig != nil {
+		return tls.DialWithDialer(dialer, t.network, t.address, t.TLSConfig)
+	}
+	return dialer.Dial(t.network, t.address)
+}
+
+func (t *NetTransport) listen(network, address string) error {
+	t.init()
 	var err error
-	t.c, err = net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	t.network = network
+	switch network {
+	case "ws":
+		t.l, err = net.Listen("tcp", address)
+	case "unix":
+		t.l, err = listenUnix(address)
+	default:
+		t.l, err = net.Listen(network, address)
+	}
 	if err != nil {
 		return err
 	}
-	go t.parseMsg()
+	if t.TLSConfig != nil {
+		t.l = tls.NewListener(t.l, t.TLSConfig)
+	}
+	if network == "ws" {
+		t.l = newWsListener(t.l, t.WsOrigins)
+	}
+	go t.accept()
 
 	return nil
 }
 
-func (t *Transport) parseMsg() {
-	var lineBuf bytes.Buffer
-	r := bufio.NewReader(t.c)
-	readHead := true
-	cmd := 0
+// isLoopbackHost reports whether host is localhost or a loopback ip
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// unixListener removes its socket file when it's closed
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	_ = os.Remove(l.path)
+	return err
+}
+
+// listenUnix listens on a unix domain socket at path which is only accessible
+// by the current user. The socket is made in a private directory and moved to
+// path when it's restricted, so no one can connect before
+func listenUnix(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".emmy")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket file is moved, it's removed by unixListener
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	if err := placeSocket(tmp, path); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// placeSocket moves the socket at tmp to path, which may be made by someone
+// else since removeStaleSocket. It's never replaced
+func placeSocket(tmp, path string) error {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", path)
+		}
+		return fmt.Errorf("%s is in use", path)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// unlike rename, link fails if path is made right now
+	return os.Link(tmp, path)
+}
+
+// removeStaleSocket removes the socket left at path by a dead process, it
+// fails if path is something else or still in use
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		_ = c.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
 
+// ServeConn serves the connection c accepted by the caller, the handler
+// should be set before. The handler gets a Stop action when c is closed
+func (t *NetTransport) ServeConn(c net.Conn) {
+	t.init()
+	t.setConn(c)
+	go t.serve()
+}
+
+func (t *NetTransport) accept() {
+	c, err := t.l.Accept()
+	if t.Reconnect == nil {
+		_ = t.l.Close()
+	}
+	if err != nil {
+		if !t.isClosed() {
+			log.Println("accept ide fail:", err)
+		}
+		return
+	}
+	t.setConn(c)
+	t.serve()
+}
+
+func (t *NetTransport) serve() {
 	for {
-		tmpLine, isPrefix, err := r.ReadLine()
-		if err != nil {
-			t.Handler(proto.MsgIdActionReq, &proto.ActionReq{Action: proto.Stop})
-			break
+		t.parseMsg()
+		_ = t.c.Close()
+		t.setConn(nil)
+		if t.isClosed() {
+			return
 		}
-		lineBuf.Write(tmpLine)
-		if isPrefix {
-			continue
+		if t.Reconnect == nil || !t.reconnect() {
+			if t.handler != nil {
+				t.handler(proto.MsgIdActionReq, &proto.ActionReq{Action: proto.Stop})
+			}
+			return
 		}
+	}
+}
 
-		if readHead {
-			cmd, err = strconv.Atoi(lineBuf.String())
-			if err != nil {
-				log.Println("parse cmd error:", err)
-				_ = t.c.Close()
-				break
+func (t *NetTransport) reconnect() bool {
+	if t.handler != nil {
+		t.handler(MsgIdDisconnected, nil)
+	}
+
+	if t.l != nil {
+		c, err := t.l.Accept()
+		if err != nil {
+			if !t.isClosed() {
+				log.Println("accept ide fail:", err)
 			}
-			lineBuf = bytes.Buffer{}
-			readHead = false
+			return false
+		}
+		t.setConn(c)
+		return true
+	}
+
+	backoff := t.Reconnect.MinBackoff
+	for i := 0; t.Reconnect.MaxRetries <= 0 || i < t.Reconnect.MaxRetries; i++ {
+		time.Sleep(backoff)
+		if t.isClosed() {
+			return false
+		}
+
+		c, err := t.dialConn()
+		if err == nil {
+			t.setConn(c)
+			return true
+		}
+		log.Println("reconnect ide fail:", err)
+
+		backoff *= 2
+		if backoff > t.Reconnect.MaxBackoff {
+			backoff = t.Reconnect.MaxBackoff
+		}
+	}
+	return false
+}
+
+// Close closes the connection and the listener, the handler won't be
+// notified. The queued messages are still written if possible
+func (t *NetTransport) Close() error {
+	t.init()
+	atomic.StoreInt32(&t.closed, 1)
+	if t.l != nil {
+		_ = t.l.Close()
+	}
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	<-t.stopped
+
+	if c := t.conn(); c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+func (t *NetTransport) isClosed() bool {
+	return atomic.LoadInt32(&t.closed) != 0
+}
+
+func (t *NetTransport) init() {
+	t.initOnce.Do(func() {
+		size := t.QueueSize
+		if size <= 0 {
+			size = DefaultQueueSize
+		}
+		t.out = make(chan []byte, size)
+		t.done = make(chan struct{})
+		t.stopped = make(chan struct{})
+		go t.write()
+	})
+}
+
+func (t *NetTransport) conn() net.Conn {
+	t.mutexConn.Lock()
+	defer t.mutexConn.Unlock()
+	return t.c
+}
+
+func (t *NetTransport) setConn(c net.Conn) {
+	t.mutexConn.Lock()
+	t.c = c
+	t.mutexConn.Unlock()
+}
+
+func (t *NetTransport) parseMsg() {
+	if t.network == "ws" {
+		t.parseWsMsg()
+		return
+	}
+
+	r := bufio.NewReader(t.c)
+	for {
+		cmd, msg, err := readFrame(r, t.maxFrameSize(), t.newMsg)
+		if fe, ok := err.(*frameError); ok {
+			t.rejectFrame(fe)
 			continue
 		}
+		if err != nil {
+			break
+		}
+
+		if t.handler != nil {
+			t.handler(cmd, msg)
+		}
+	}
+}
+
+// newMsg returns a new message to decode cmd into, nil if the peer must not
+// send it: the debugger end only accepts the requests of the IDE
+func (t *NetTransport) newMsg(cmd int) interface{} {
+	if t.requestsOnly {
+		return proto.GetReq(cmd)
+	}
+	return proto.GetMsg(cmd)
+}
+
+func (t *NetTransport) maxFrameSize() int {
+	if t.MaxFrameSize > 0 {
+		return t.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
+
+// rejectFrame reports the dropped message to the handler
+func (t *NetTransport) rejectFrame(fe *frameError) {
+	log.Println("drop msg:", fe)
+	if t.handler != nil {
+		t.handler(MsgIdFrameError, &proto.ErrorNotify{Cmd: fe.cmd, Error: fe.err.Error()})
+	}
+}
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// frameError is a message which can't be decoded, the stream is still fine
+type frameError struct {
+	cmd int
+	err error
+}
+
+func (e *frameError) Error() string {
+	return fmt.Sprintf("cmd %d: %v", e.cmd, e.err)
+}
+
+// readFrame reads a message of the line protocol, the cmd in a line and the
+// json in the next line, decoded into newMsg(cmd). It returns a *frameError if
+// only this message is bad
+func readFrame(r *bufio.Reader, maxSize int, newMsg func(int) interface{}) (int, interface{}, error) {
+	head, err := readLine(r, maxSize)
+	if err == errFrameTooLarge {
+		return 0, nil, &frameError{err: err}
+	} else if err != nil {
+		return 0, nil, err
+	}
+	cmd, err := strconv.Atoi(string(head))
+	if err != nil {
+		// it may be a json line, try the next one as the cmd
+		return 0, nil, &frameError{err: errors.New("invalid cmd line")}
+	}
+
+	body, err := readLine(r, maxSize)
+	if err == errFrameTooLarge {
+		return cmd, nil, &frameError{cmd: cmd, err: err}
+	} else if err != nil {
+		return 0, nil, err
+	}
+	msg := newMsg(cmd)
+	if msg == nil {
+		return cmd, nil, &frameError{cmd: cmd, err: errors.New("unknown cmd")}
+	}
+	if err := json.Unmarshal(body, msg); err != nil {
+		return cmd, nil, &frameError{cmd: cmd, err: err}
+	}
+	return cmd, msg, nil
+}
 
-		msg := proto.GetMsg(cmd)
-		if err = json.Unmarshal(lineBuf.Bytes(), msg); err != nil {
-			log.Println("unmarshal json fail", err)
+// readLine reads a line without the line end, a line longer than maxSize is
+// skipped and errFrameTooLarge returned
+func readLine(r *bufio.Reader, maxSize int) ([]byte, error) {
+	var line []byte
+	tooLarge := false
+	for {
+		part, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if !tooLarge {
+			line = append(line, part...)
+			if len(line) > maxSize {
+				tooLarge = true
+				line = nil
+			}
+		}
+		if !isPrefix {
 			break
 		}
+	}
+	if tooLarge {
+		return nil, errFrameTooLarge
+	}
+	return line, nil
+}
+
+// Send queues the message for the writer goroutine, it blocks while the
+// queue is full, at most until the queued messages are written or timed out.
+// The messages sent while the connection is lost are dropped
+func (t *NetTransport) Send(cmd int, msg interface{}) {
+	t.init()
+	var data []byte
+	var err error
+	if t.network == "ws" {
+		data, err = encodeWsFrame(cmd, msg)
+	} else {
+		data, err = encodeMsg(cmd, msg)
+	}
+	if err != nil {
+		log.Println("send msg fail:", err)
+		return
+	}
+
+	select {
+	case t.out <- data:
+	case <-t.done:
+	}
+}
 
-		if t.Handler != nil {
-			t.Handler(cmd, msg)
+// write writes the queued messages in order until the transport is closed,
+// then the remaining ones within closeFlushTimeout
+func (t *NetTransport) write() {
+	defer close(t.stopped)
+	for {
+		select {
+		case data := <-t.out:
+			if data == nil {
+				t.dropConn()
+				continue
+			}
+			t.writeMsg(data, t.writeDeadline())
+		case <-t.done:
+			deadline := time.Now().Add(closeFlushTimeout)
+			for {
+				select {
+				case data := <-t.out:
+					if data != nil {
+						t.writeMsg(data, deadline)
+					}
+				default:
+					return
+				}
+			}
 		}
+	}
+}
+
+// Drop closes the connection once the queued messages are written, like the
+// connection is lost, the transport reconnects or reports a Stop action. It
+// closes the connection right away if the queue is full
+func (t *NetTransport) Drop() {
+	t.init()
+	select {
+	case t.out <- nil:
+	case <-t.done:
+	default:
+		// e.g. the handler of MsgIdSendFailed, which runs on the writer
+		t.dropConn()
+	}
+}
+
+func (t *NetTransport) writeDeadline() time.Time {
+	switch {
+	case t.WriteTimeout < 0:
+		return time.Time{}
+	case t.WriteTimeout == 0:
+		return time.Now().Add(DefaultWriteTimeout)
+	}
+	return time.Now().Add(t.WriteTimeout)
+}
 
-		lineBuf = bytes.Buffer{}
-		readHead = true
+func (t *NetTransport) dropConn() {
+	if c := t.conn(); c != nil {
+		_ = c.Close()
 	}
 }
 
-func (t *Transport) Send(cmd int, msg interface{}) {
-	if t.c == nil {
+func (t *NetTransport) writeMsg(data []byte, deadline time.Time) {
+	c := t.conn()
+	if c == nil || c == t.failed {
+		return
+	}
+
+	_ = c.SetWriteDeadline(deadline)
+	var err error
+	if t.network == "ws" {
+		err = websocket.Message.Send(c.(*wsConn).Conn, string(data))
+	} else {
+		_, err = c.Write(data)
+	}
+	if err == nil || t.isClosed() {
 		return
 	}
+
+	// the reader finds the connection closed, then reconnects or stops
+	t.failed = c
+	_ = c.Close()
+	if t.handler != nil {
+		t.handler(MsgIdSendFailed, err)
+	} else {
+		log.Println("send msg fail:", err)
+	}
+}
+
+func encodeMsg(cmd int, msg interface{}) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
 	buf := bytes.Buffer{}
 	buf.WriteString(fmt.Sprintf("%d\n", cmd))
-	data, _ := json.Marshal(msg)
 	buf.Write(data)
 	buf.WriteString("\n")
-
-	if _, err := io.Copy(t.c, &buf); err != nil {
-		log.Println("send msg fail:", string(data), err)
-	}
+	return buf.Bytes(), nil
 }
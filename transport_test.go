@@ -1,10 +1,550 @@
 package lua_debugger
 
-import "testing"
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/edolphin-ydf/gopherlua-debugger/proto"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestTransport_Connect(t *testing.T) {
-	trans := Transport{}
-	if err := trans.Connect("localhost", 9966); err != nil {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
 		t.Fatal(err)
 	}
+	defer l.Close()
+
+	trans := NetTransport{}
+	addr := l.Addr().(*net.TCPAddr)
+	if err := trans.Connect("127.0.0.1", addr.Port); err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Close()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	trans.Send(proto.MsgIdInitRsp, proto.InitRsp{Version: "1"})
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != fmt.Sprintf("%d\n", proto.MsgIdInitRsp) {
+		t.Fatal("unexpected cmd line", line)
+	}
+}
+
+func TestTransport_Listen(t *testing.T) {
+	trans := NetTransport{}
+	received := handleInitReq(&trans)
+	if err := trans.Listen("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	c := sendInitReq(t, "tcp", trans.l.Addr().String())
+	defer c.Close()
+	expectInitReq(t, received)
+}
+
+func TestTransport_PipeListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emmy.sock")
+	trans := NetTransport{}
+	received := handleInitReq(&trans)
+	if err := trans.PipeListen(path); err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatal("unexpected socket permission", info.Mode().Perm())
+	}
+
+	c := sendInitReq(t, "unix", path)
+	defer c.Close()
+	expectInitReq(t, received)
+}
+
+func TestTransport_PipeListenExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emmy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a file which is not a socket is kept
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&NetTransport{}).PipeListen(path); err == nil {
+		t.Fatal("file replaced by the socket")
+	}
+
+	// a socket left by a dead process is replaced
+	path = filepath.Join(dir, "emmy.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	_ = l.Close()
+	trans := NetTransport{}
+	received := handleInitReq(&trans)
+	if err := trans.PipeListen(path); err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Close()
+	c := sendInitReq(t, "unix", path)
+	defer c.Close()
+	expectInitReq(t, received)
+
+	// a socket in use is kept
+	path = filepath.Join(dir, "used.sock")
+	used, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	if err := (&NetTransport{}).PipeListen(path); err == nil {
+		t.Fatal("socket in use replaced")
+	}
+}
+
+func TestTransport_PlaceSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emmy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "tmp.sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// made after the stale socket is removed
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := placeSocket(tmp, path); err == nil {
+		t.Fatal("file replaced by the socket")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "data" {
+		t.Fatal("file changed", string(data))
+	}
+	if err := placeSocket(tmp, tmp); err == nil {
+		t.Fatal("socket replaced")
+	}
+
+	path = filepath.Join(dir, "emmy.sock")
+	if err := placeSocket(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+}
+
+func TestTransport_Reconnect(t *testing.T) {
+	trans := NetTransport{Reconnect: DefaultReconnectPolicy()}
+	received := make(chan int, 4)
+	trans.SetHandler(func(cmd int, msg interface{}) {
+		received <- cmd
+	})
+	if err := trans.Listen("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Close()
+
+	expectCmd := func(expected int) {
+		select {
+		case cmd := <-received:
+			if cmd != expected {
+				t.Fatal("unexpected cmd", cmd)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("cmd not received", expected)
+		}
+	}
+
+	c, err := net.Dial("tcp", trans.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(c, "%d\n{}\n", proto.MsgIdReadyReq); err != nil {
+		t.Fatal(err)
+	}
+	expectCmd(proto.MsgIdReadyReq)
+	_ = c.Close()
+	expectCmd(MsgIdDisconnected)
+
+	c = sendInitReq(t, "tcp", trans.l.Addr().String())
+	defer c.Close()
+	expectCmd(proto.MsgIdInitReq)
+}
+
+func TestTransport_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emmy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := generateCerts(t, dir)
+
+	serverConfig, err := LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NetTransport{TLSConfig: serverConfig}
+	received := handleInitReq(&server)
+	if err := server.Listen("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	clientConfig, err := LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NetTransport{TLSConfig: clientConfig}
+	client.SetHandler(func(int, interface{}) {})
+	addr := server.l.Addr().(*net.TCPAddr)
+	if err := client.Connect("127.0.0.1", addr.Port); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Send(proto.MsgIdInitReq, proto.InitReq{Ext: []string{".lua"}})
+	expectInitReq(t, received)
+}
+
+func TestTransport_WsListen(t *testing.T) {
+	server := NetTransport{}
+	received := handleInitReq(&server)
+	if err := server.WsListen("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// play a browser, one json message with the cmd per frame
+	url := "ws://" + server.l.Addr().String() + "/debug"
+	ws, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	frame := fmt.Sprintf(`{"cmd":%d,"emmyHelper":"","ext":[".lua"]}`, proto.MsgIdInitReq)
+	if err := websocket.Message.Send(ws, frame); err != nil {
+		t.Fatal(err)
+	}
+	expectInitReq(t, received)
+
+	server.Send(proto.MsgIdEvalRsp, proto.EvalRsp{Seq: 1, Success: true})
+	var rsp struct {
+		Cmd int `json:"cmd"`
+		proto.EvalRsp
+	}
+	if err := websocket.JSON.Receive(ws, &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Cmd != proto.MsgIdEvalRsp || rsp.Seq != 1 || !rsp.Success {
+		t.Fatal("unexpected frame", rsp)
+	}
+}
+
+func TestTransport_WsOrigin(t *testing.T) {
+	server := NetTransport{WsOrigins: []string{"https://ide.example.com"}}
+	server.SetHandler(func(int, interface{}) {})
+	if err := server.WsListen("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	url := "ws://" + server.l.Addr().String() + "/"
+	if ws, err := websocket.Dial(url, "", "https://attacker.example.com"); err == nil {
+		ws.Close()
+		t.Fatal("origin not checked")
+	}
+	ws, err := websocket.Dial(url, "", "https://ide.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+}
+
+func TestTransport_WsConnect(t *testing.T) {
+	server := NetTransport{}
+	received := handleInitReq(&server)
+	if err := server.WsListen("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := NetTransport{}
+	client.SetHandler(func(int, interface{}) {})
+	if err := client.WsConnect("ws://" + server.l.Addr().String() + "/"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Send(proto.MsgIdInitReq, proto.InitReq{Ext: []string{".lua"}})
+	expectInitReq(t, received)
+}
+
+// generateCerts writes a self-signed ca and a certificate for 127.0.0.1,
+// usable by both the client and the server, into dir
+func generateCerts(t *testing.T, dir string) (certFile, keyFile, caFile string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "emmy test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "emmy test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePem := func(name, typ string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: data}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	return writePem("cert.pem", "CERTIFICATE", der),
+		writePem("key.pem", "EC PRIVATE KEY", keyDer),
+		writePem("ca.pem", "CERTIFICATE", caDer)
+}
+
+func TestTransport_ConcurrentSend(t *testing.T) {
+	trans := NetTransport{}
+	if err := trans.Listen("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Close()
+	c, err := net.Dial("tcp", trans.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for trans.conn() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	const senders, count = 8, 100
+	for i := 0; i < senders; i++ {
+		go func(sender int) {
+			for j := 0; j < count; j++ {
+				trans.Send(proto.MsgIdEvalRsp, proto.EvalRsp{Seq: sender*count + j})
+			}
+		}(i)
+	}
+
+	// every frame is complete and the messages of a sender are in order
+	next := make([]int, senders)
+	r := bufio.NewReader(c)
+	for i := 0; i < senders*count; i++ {
+		cmd, _ := r.ReadString('\n')
+		if cmd != fmt.Sprintf("%d\n", proto.MsgIdEvalRsp) {
+			t.Fatal("unexpected cmd line", cmd)
+		}
+		line, _ := r.ReadBytes('\n')
+		var rsp proto.EvalRsp
+		if err := json.Unmarshal(line, &rsp); err != nil {
+			t.Fatal(err)
+		}
+		sender := rsp.Seq / count
+		if rsp.Seq%count != next[sender] {
+			t.Fatal("out of order", rsp.Seq)
+		}
+		next[sender]++
+	}
+}
+
+func TestTransport_WriteTimeout(t *testing.T) {
+	trans := NetTransport{WriteTimeout: 100 * time.Millisecond}
+	failed := make(chan error, 1)
+	var failures int32
+	trans.SetHandler(func(cmd int, msg interface{}) {
+		if cmd == MsgIdSendFailed {
+			// like the facade, with the queue full
+			trans.Drop()
+			if atomic.AddInt32(&failures, 1) == 1 {
+				failed <- msg.(error)
+			}
+		}
+	})
+	if err := trans.Listen("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Close()
+	// the IDE never reads
+	c, err := net.Dial("tcp", trans.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for trans.conn() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	big := strings.Repeat("x", 1<<20)
+	go func() {
+		for i := 0; i < 64; i++ {
+			trans.Send(proto.MsgIdEvalRsp, proto.EvalRsp{Error: big})
+		}
+	}()
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write not timed out")
+	}
+
+	// the other messages of the connection are dropped without blocking
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*DefaultQueueSize; i++ {
+			trans.Send(proto.MsgIdEvalRsp, proto.EvalRsp{})
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("send blocked after the write failed")
+	}
+	if n := atomic.LoadInt32(&failures); n != 1 {
+		t.Fatal("send failed reported", n, "times")
+	}
+}
+
+func TestTransport_BadFrames(t *testing.T) {
+	trans := NetTransport{MaxFrameSize: 64, requestsOnly: true}
+	received := make(chan *proto.InitReq, 1)
+	dropped := make(chan *proto.ErrorNotify, 4)
+	trans.SetHandler(func(cmd int, msg interface{}) {
+		switch cmd {
+		case proto.MsgIdInitReq:
+			received <- msg.(*proto.InitReq)
+		case MsgIdFrameError:
+			dropped <- msg.(*proto.ErrorNotify)
+		}
+	})
+	if err := trans.Listen("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Close()
+
+	c, err := net.Dial("tcp", trans.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the debugger end doesn't take the messages of the debugger either
+	_, _ = fmt.Fprintf(c, "999\n{}\n%d\n{bad json\n%d\n{\"ext\":[\"%s\"]}\n%d\n{}\n",
+		proto.MsgIdInitReq, proto.MsgIdInitReq, strings.Repeat("x", 100), proto.MsgIdBreakNotify)
+
+	for _, cmd := range []int{999, proto.MsgIdInitReq, proto.MsgIdInitReq, proto.MsgIdBreakNotify} {
+		select {
+		case notify := <-dropped:
+			if notify.Cmd != cmd || notify.Error == "" {
+				t.Fatal("unexpected frame error", notify)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("bad frame not reported")
+		}
+	}
+
+	// the session goes on
+	_, _ = fmt.Fprintf(c, "%d\n{\"ext\":[\".lua\"]}\n", proto.MsgIdInitReq)
+	expectInitReq(t, received)
+}
+
+func handleInitReq(trans Transport) <-chan *proto.InitReq {
+	received := make(chan *proto.InitReq, 1)
+	trans.SetHandler(func(cmd int, msg interface{}) {
+		if cmd == proto.MsgIdInitReq {
+			received <- msg.(*proto.InitReq)
+		}
+	})
+	return received
+}
+
+func sendInitReq(t *testing.T, network, address string) net.Conn {
+	c, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(c, "%d\n{\"emmyHelper\":\"\",\"ext\":[\".lua\"]}\n", proto.MsgIdInitReq); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func expectInitReq(t *testing.T, received <-chan *proto.InitReq) {
+	select {
+	case req := <-received:
+		if len(req.Ext) != 1 || req.Ext[0] != ".lua" {
+			t.Fatal("unexpected init req", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("init req not received")
+	}
 }
@@ -71,6 +71,24 @@ type Stack struct {
 	UpvalueVariables []*Variable
 }
 
+func (s *Stack) toProto() proto.Stack {
+	res := proto.Stack{
+		Level:            s.Level,
+		File:             s.File,
+		FunctionName:     s.FunctionName,
+		Line:             s.Line,
+		LocalVariables:   []*proto.Variable{},
+		UpvalueVariables: []*proto.Variable{},
+	}
+	for _, variable := range s.LocalVariables {
+		res.LocalVariables = append(res.LocalVariables, variable.toProto())
+	}
+	for _, variable := range s.UpvalueVariables {
+		res.LocalVariables = append(res.LocalVariables, variable.toProto())
+	}
+	return res
+}
+
 type EvalContext struct {
 	Expr       string
 	Error      string
@@ -80,4 +98,6 @@ type EvalContext struct {
 	CacheId    int
 	Result     *Variable
 	Success    bool
+	// done gets the result instead of the IDE if it's set
+	done func(ctx *EvalContext)
 }
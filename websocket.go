@@ -0,0 +1,193 @@
+package lua_debugger
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// wsConn is a websocket connection, closing it releases the http handler
+// serving it
+type wsConn struct {
+	*websocket.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newWsConn(ws *websocket.Conn) *wsConn {
+	ws.PayloadType = websocket.TextFrame
+	return &wsConn{Conn: ws, closed: make(chan struct{})}
+}
+
+func (c *wsConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// DefaultWsOrigin is the Origin sent by WsConnect if NetTransport.WsOrigin
+// is not set
+const DefaultWsOrigin = "http://localhost/"
+
+func dialWs(url, origin string, dialer *net.Dialer, tlsConfig *tls.Config) (net.Conn, error) {
+	if origin == "" {
+		origin = DefaultWsOrigin
+	}
+	config, err := websocket.NewConfig(url, origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = dialer
+	config.TlsConfig = tlsConfig
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return newWsConn(ws), nil
+}
+
+// wsListener is a net.Listener accepting the websocket connections of an
+// http server
+type wsListener struct {
+	l     net.Listener
+	srv   *http.Server
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newWsListener(l net.Listener, origins []string) *wsListener {
+	wl := &wsListener{
+		l:     l,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	wl.srv = &http.Server{Handler: websocket.Server{
+		Handler:   wl.handle,
+		Handshake: checkWsOrigin(origins),
+	}}
+	go func() {
+		_ = wl.srv.Serve(l)
+	}()
+	return wl
+}
+
+// checkWsOrigin rejects the web pages not from a loopback host nor in
+// origins, or any web page could debug the process the user visits it with.
+// The clients without an Origin are not browsers, they're allowed
+func checkWsOrigin(origins []string) func(*websocket.Config, *http.Request) error {
+	return func(config *websocket.Config, req *http.Request) error {
+		origin, err := websocket.Origin(config, req)
+		if err != nil {
+			return err
+		}
+		config.Origin = origin
+		if origin == nil || isLoopbackHost(origin.Hostname()) {
+			return nil
+		}
+		for _, allowed := range origins {
+			if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin.Scheme+"://"+origin.Host) {
+				return nil
+			}
+		}
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+}
+
+func (wl *wsListener) handle(ws *websocket.Conn) {
+	c := newWsConn(ws)
+	select {
+	case wl.conns <- c:
+		// the connection is closed when the handler returns
+		<-c.closed
+	case <-wl.done:
+	}
+}
+
+func (wl *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-wl.conns:
+		return c, nil
+	case <-wl.done:
+		return nil, errors.New("websocket listener closed")
+	}
+}
+
+// Close stops accepting, the accepted connections are not affected
+func (wl *wsListener) Close() error {
+	wl.once.Do(func() {
+		close(wl.done)
+	})
+	return wl.l.Close()
+}
+
+func (wl *wsListener) Addr() net.Addr {
+	return wl.l.Addr()
+}
+
+func (t *NetTransport) parseWsMsg() {
+	ws := t.c.(*wsConn)
+	ws.MaxPayloadBytes = t.maxFrameSize()
+	for {
+		var data []byte
+		err := websocket.Message.Receive(ws.Conn, &data)
+		if err == websocket.ErrFrameTooLarge {
+			// the rest of the frame is skipped by the next Receive
+			t.rejectFrame(&frameError{err: errFrameTooLarge})
+			continue
+		} else if err != nil {
+			break
+		}
+
+		cmd, msg, err := decodeWsFrame(data, t.newMsg)
+		if err != nil {
+			t.rejectFrame(&frameError{cmd: cmd, err: err})
+			continue
+		}
+
+		if t.handler != nil {
+			t.handler(cmd, msg)
+		}
+	}
+}
+
+// encodeWsFrame adds the cmd field to the json object of msg, like the
+// messages of the native emmy_core
+func encodeWsFrame(cmd int, msg interface{}) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["cmd"] = json.RawMessage(strconv.Itoa(cmd))
+	return json.Marshal(fields)
+}
+
+func decodeWsFrame(data []byte, newMsg func(int) interface{}) (int, interface{}, error) {
+	var head struct {
+		Cmd int `json:"cmd"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return 0, nil, err
+	}
+
+	msg := newMsg(head.Cmd)
+	if msg == nil {
+		return head.Cmd, nil, errors.New("unknown cmd")
+	}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return head.Cmd, nil, err
+	}
+	return head.Cmd, msg, nil
+}